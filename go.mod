@@ -3,10 +3,15 @@ module TeslaBle2Mqtt
 go 1.23.4
 
 require (
-	github.com/akamensky/argparse v1.4.0 // indirect
+	github.com/akamensky/argparse v1.4.0
+	github.com/charmbracelet/log v0.4.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
 	github.com/aymanbagabas/go-osc52/v2 v2.0.1 // indirect
 	github.com/charmbracelet/lipgloss v0.10.0 // indirect
-	github.com/charmbracelet/log v0.4.0 // indirect
+	github.com/eclipse/paho.golang v0.22.0 // indirect
 	github.com/eclipse/paho.mqtt.golang v1.5.0 // indirect
 	github.com/go-logfmt/logfmt v0.6.0 // indirect
 	github.com/gorilla/websocket v1.5.3 // indirect
@@ -20,5 +25,4 @@ require (
 	golang.org/x/net v0.34.0 // indirect
 	golang.org/x/sync v0.7.0 // indirect
 	golang.org/x/sys v0.29.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
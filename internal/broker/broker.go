@@ -0,0 +1,52 @@
+package broker
+
+import (
+	"TeslaBle2Mqtt/internal/settings"
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+var tls_config *tls.Config
+
+// Init loads the MQTT broker configuration shared by all clients (TLS certificates, etc.).
+// It should be called once at startup, so that invalid configuration is reported before
+// any handler is started.
+func Init() error {
+	s := settings.Get()
+	var err error
+	tls_config, err = loadTlsConfig(s)
+	return err
+}
+
+// brokerUrl returns the URL of the MQTT broker from settings. The MQTT host can either
+// be a plain hostname or a full broker URI, in which case --mqtt-port is only used if the
+// URI does not specify one (and it is not a WebSocket URI).
+func brokerUrl(s *settings.Settings) *url.URL {
+	broker_url := &url.URL{Scheme: "tcp", Host: s.MqttHost}
+	if strings.Contains(s.MqttHost, "://") {
+		// Already validated when parsing settings
+		broker_url, _ = url.Parse(s.MqttHost)
+	}
+	is_ws := broker_url.Scheme == "ws" || broker_url.Scheme == "wss"
+
+	if broker_url.Port() == "" && !is_ws {
+		broker_url.Host = fmt.Sprintf("%s:%d", broker_url.Host, s.MqttPort)
+	}
+
+	// Upgrade to a secure transport when TLS is configured
+	if tls_config != nil {
+		switch broker_url.Scheme {
+		case "tcp":
+			broker_url.Scheme = "ssl"
+		case "ws":
+			broker_url.Scheme = "wss"
+		}
+	}
+
+	if is_ws && s.MqttWsPath != "" {
+		broker_url.Path = "/" + strings.TrimPrefix(s.MqttWsPath, "/")
+	}
+	return broker_url
+}
@@ -0,0 +1,422 @@
+package broker
+
+import (
+	"TeslaBle2Mqtt/internal/settings"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Message is an incoming MQTT message routed to a subscription
+type Message struct {
+	Topic   string
+	Payload []byte
+	// MQTT 5 request/response properties, empty with MQTT 3.1.1
+	ResponseTopic   string
+	CorrelationData []byte
+}
+
+// Properties are MQTT 5 publish properties, they are ignored with MQTT 3.1.1
+type Properties struct {
+	CorrelationData []byte            `json:"correlation_data,omitempty"`
+	ContentType     string            `json:"content_type,omitempty"`
+	MessageExpiry   time.Duration     `json:"message_expiry,omitempty"`
+	User            map[string]string `json:"user,omitempty"`
+}
+
+// transport is the MQTT client implementation used by a connection
+type transport interface {
+	connect() error
+	close()
+	subscribe(topics []string) error
+	unsubscribe(topics []string) error
+	publish(ctx context.Context, topic string, retained bool, payload []byte, props *Properties) error
+}
+
+// Subscription receives messages for a set of topics on a shared connection
+type Subscription struct {
+	topics     []string
+	on_connect func()
+	// Messages routed to the subscription in order, none are dropped while its handler is busy
+	Messages chan Message
+
+	lock    sync.Mutex
+	pending []Message
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+// deliver queues a message for the subscription without blocking
+func (s *Subscription) deliver(msg Message) {
+	s.lock.Lock()
+	s.pending = append(s.pending, msg)
+	s.lock.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// forward passes queued messages on to Messages until the subscription is removed
+func (s *Subscription) forward() {
+	for {
+		s.lock.Lock()
+		if len(s.pending) == 0 {
+			s.lock.Unlock()
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		msg := s.pending[0]
+		s.pending = s.pending[1:]
+		s.lock.Unlock()
+
+		select {
+		case s.Messages <- msg:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Connection is a single MQTT session shared by all handlers. Incoming messages are routed
+// by topic to every subscription that registered the topic.
+type Connection struct {
+	transport transport
+
+	mu        sync.Mutex
+	connected bool
+	subs      []*Subscription
+	routes    map[string][]*Subscription
+	queue     *offlineQueue
+}
+
+// NewConnection creates a shared connection with the given client id. The will topic is set to
+// "offline" if the connection is lost, so it can be used as availability for all devices.
+func NewConnection(client_id string, will_topic string) (*Connection, error) {
+	s := settings.Get()
+	c := &Connection{
+		routes: make(map[string][]*Subscription),
+	}
+
+	if s.MqttStoreDir != "" {
+		if err := os.MkdirAll(s.MqttStoreDir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create MQTT store directory: %w", err)
+		}
+	}
+
+	if s.OfflineQueueSize > 0 {
+		queue_path := ""
+		if s.MqttStoreDir != "" {
+			queue_path = filepath.Join(s.MqttStoreDir, "offline_queue.json")
+		}
+		queue, err := newOfflineQueue(queue_path, s.OfflineQueueSize, DropPolicy(s.OfflineQueuePolicy))
+		if err != nil {
+			return nil, err
+		}
+		if queue.len() > 0 {
+			log.Info("Loaded offline queue", "messages", queue.len())
+		}
+		c.queue = queue
+	}
+
+	var err error
+	if s.MqttV5 {
+		c.transport, err = newMqtt5Transport(client_id, will_topic, c)
+	} else {
+		c.transport = newMqtt3Transport(client_id, will_topic, c)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Connect connects to the broker and blocks until the first connection is established
+func (c *Connection) Connect() error {
+	return c.transport.connect()
+}
+
+// Close disconnects from the broker
+func (c *Connection) Close() {
+	c.transport.close()
+}
+
+func (c *Connection) onConnect() {
+	log.Info("Connected to MQTT")
+
+	c.mu.Lock()
+	c.connected = true
+	topics := make([]string, 0, len(c.routes))
+	for topic := range c.routes {
+		topics = append(topics, topic)
+	}
+	subs := slices.Clone(c.subs)
+	c.mu.Unlock()
+
+	// Subscriptions are not kept by the broker with a clean session
+	if len(topics) > 0 {
+		if err := c.transport.subscribe(topics); err != nil {
+			log.Error("Failed to subscribe", "error", err)
+		}
+	}
+	c.replayQueue()
+	for _, sub := range subs {
+		if sub.on_connect != nil {
+			sub.on_connect()
+		}
+	}
+}
+
+func (c *Connection) onConnectionLost(err error) {
+	log.Error("Connection lost to MQTT", "error", err)
+	c.mu.Lock()
+	c.connected = false
+	c.mu.Unlock()
+}
+
+func (c *Connection) route(msg Message) {
+	c.mu.Lock()
+	subs := slices.Clone(c.routes[msg.Topic])
+	c.mu.Unlock()
+
+	if len(subs) == 0 {
+		log.Warn("No subscription for message", "topic", msg.Topic)
+		return
+	}
+	// Runs on the callback of the MQTT client, which is shared by every subscription, so a
+	// handler that is busy (e.g. waiting for a command) must not block the others
+	for _, sub := range subs {
+		sub.deliver(msg)
+	}
+}
+
+// Subscribe registers a subscription for the given topics. The on_connect callback is called each time
+// the connection is (re)established, or immediately if the connection is already up.
+func (c *Connection) Subscribe(topics []string, on_connect func()) (*Subscription, error) {
+	sub := &Subscription{
+		topics:     topics,
+		on_connect: on_connect,
+		Messages:   make(chan Message),
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	go sub.forward()
+
+	c.mu.Lock()
+	c.subs = append(c.subs, sub)
+	new_topics := []string{}
+	for _, topic := range topics {
+		if len(c.routes[topic]) == 0 {
+			new_topics = append(new_topics, topic)
+		}
+		c.routes[topic] = append(c.routes[topic], sub)
+	}
+	connected := c.connected
+	c.mu.Unlock()
+
+	if connected {
+		if len(new_topics) > 0 {
+			if err := c.transport.subscribe(new_topics); err != nil {
+				return sub, fmt.Errorf("failed to subscribe: %w", err)
+			}
+		}
+		if on_connect != nil {
+			on_connect()
+		}
+	}
+	return sub, nil
+}
+
+// Unsubscribe removes a subscription, topics no other subscription uses are unsubscribed from the broker
+func (c *Connection) Unsubscribe(sub *Subscription) {
+	close(sub.done)
+	c.mu.Lock()
+	c.subs = slices.DeleteFunc(c.subs, func(s *Subscription) bool { return s == sub })
+	unused := []string{}
+	for _, topic := range sub.topics {
+		c.routes[topic] = slices.DeleteFunc(c.routes[topic], func(s *Subscription) bool { return s == sub })
+		if len(c.routes[topic]) == 0 {
+			delete(c.routes, topic)
+			unused = append(unused, topic)
+		}
+	}
+	connected := c.connected
+	c.mu.Unlock()
+
+	if connected && len(unused) > 0 {
+		if err := c.transport.unsubscribe(unused); err != nil {
+			log.Error("Failed to unsubscribe", "error", err)
+		}
+	}
+}
+
+// Resubscribe changes the topics of a subscription, without calling its on connect callback
+func (c *Connection) Resubscribe(sub *Subscription, topics []string) error {
+	c.mu.Lock()
+	new_topics := []string{}
+	for _, topic := range topics {
+		if slices.Contains(sub.topics, topic) {
+			continue
+		}
+		if len(c.routes[topic]) == 0 {
+			new_topics = append(new_topics, topic)
+		}
+		c.routes[topic] = append(c.routes[topic], sub)
+	}
+	unused := []string{}
+	for _, topic := range sub.topics {
+		if slices.Contains(topics, topic) {
+			continue
+		}
+		c.routes[topic] = slices.DeleteFunc(c.routes[topic], func(s *Subscription) bool { return s == sub })
+		if len(c.routes[topic]) == 0 {
+			delete(c.routes, topic)
+			unused = append(unused, topic)
+		}
+	}
+	sub.topics = topics
+	connected := c.connected
+	c.mu.Unlock()
+
+	if connected {
+		if len(unused) > 0 {
+			if err := c.transport.unsubscribe(unused); err != nil {
+				log.Error("Failed to unsubscribe", "error", err)
+			}
+		}
+		if len(new_topics) > 0 {
+			if err := c.transport.subscribe(new_topics); err != nil {
+				return fmt.Errorf("failed to subscribe: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Publish publishes a message and waits until it is sent or the context is done
+func (c *Connection) Publish(ctx context.Context, topic string, retained bool, payload any) error {
+	return c.PublishWithProperties(ctx, topic, retained, payload, nil)
+}
+
+// PublishWithProperties publishes a message with MQTT 5 properties and waits until it is sent or the context is done
+func (c *Connection) PublishWithProperties(ctx context.Context, topic string, retained bool, payload any, props *Properties) error {
+	var payload_bytes []byte
+	switch p := payload.(type) {
+	case string:
+		payload_bytes = []byte(p)
+	case []byte:
+		payload_bytes = p
+	default:
+		return fmt.Errorf("unsupported payload type %T", payload)
+	}
+	return c.transport.publish(ctx, topic, retained, payload_bytes, props)
+}
+
+// PublishQueued publishes a message like PublishWithProperties, but if the broker is unreachable the message is
+// put in the offline queue (if enabled) and replayed in order once the connection is re-established.
+func (c *Connection) PublishQueued(ctx context.Context, topic string, retained bool, payload any, props *Properties) error {
+	c.mu.Lock()
+	// Keep the order of messages if there are messages waiting to be replayed
+	if c.queue != nil && (!c.connected || c.queue.len() > 0) {
+		err := c.enqueue(topic, retained, payload, props)
+		c.mu.Unlock()
+		return err
+	}
+	c.mu.Unlock()
+
+	err := c.PublishWithProperties(ctx, topic, retained, payload, props)
+	if err != nil && ctx.Err() == nil && c.queue != nil {
+		log.Warn("Failed to publish, queueing message", "topic", topic, "error", err)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.enqueue(topic, retained, payload, props)
+	}
+	return err
+}
+
+// enqueue adds a message to the offline queue, c.mu must be held
+func (c *Connection) enqueue(topic string, retained bool, payload any, props *Properties) error {
+	var payload_bytes []byte
+	switch p := payload.(type) {
+	case string:
+		payload_bytes = []byte(p)
+	case []byte:
+		payload_bytes = p
+	default:
+		return fmt.Errorf("unsupported payload type %T", payload)
+	}
+	dropped, err := c.queue.push(queuedMessage{
+		Topic:      topic,
+		Payload:    payload_bytes,
+		Retained:   retained,
+		Properties: props,
+		Queued:     time.Now(),
+	})
+	if dropped {
+		log.Warn("Offline queue is full, dropped message", "policy", c.queue.policy, "size", c.queue.size)
+	}
+	if err != nil {
+		log.Error("Failed to persist offline queue", "error", err)
+	}
+	return nil
+}
+
+// replayQueue publishes all queued messages in order, it stops at the first failure. Messages are
+// published without holding c.mu, PublishQueued keeps pushing to the queue meanwhile.
+func (c *Connection) replayQueue() {
+	if c.queue == nil {
+		return
+	}
+	replayed := 0
+	for {
+		c.mu.Lock()
+		msg, ok := c.queue.peek()
+		c.mu.Unlock()
+		if !ok {
+			break
+		}
+
+		props := msg.Properties
+		expired := false
+		if props != nil && props.MessageExpiry > 0 {
+			// Only publish the remaining lifetime of the message
+			remaining := props.MessageExpiry - time.Since(msg.Queued)
+			expired = remaining <= 0
+			props_copy := *props
+			props_copy.MessageExpiry = remaining
+			props = &props_copy
+		}
+		if !expired {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			err := c.transport.publish(ctx, msg.Topic, msg.Retained, msg.Payload, props)
+			cancel()
+			if err != nil {
+				c.mu.Lock()
+				remaining := c.queue.len()
+				c.mu.Unlock()
+				log.Error("Failed to replay offline queue", "remaining", remaining, "error", err)
+				return
+			}
+			replayed++
+		}
+
+		c.mu.Lock()
+		if err := c.queue.remove(msg.Id); err != nil {
+			log.Error("Failed to persist offline queue", "error", err)
+		}
+		c.mu.Unlock()
+	}
+	if replayed > 0 {
+		log.Info("Replayed offline queue", "messages", replayed)
+	}
+}
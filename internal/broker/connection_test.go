@@ -0,0 +1,39 @@
+package broker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// A busy subscription gets every message in order once it reads again, without blocking the others
+func TestRouteBusySubscription(t *testing.T) {
+	c := &Connection{routes: make(map[string][]*Subscription)}
+	busy, _ := c.Subscribe([]string{"cmd", "homeassistant/status"}, nil)
+	defer c.Unsubscribe(busy)
+	other, _ := c.Subscribe([]string{"other"}, nil)
+	defer c.Unsubscribe(other)
+
+	for i := 0; i < 100; i++ {
+		c.route(Message{Topic: "cmd", Payload: []byte(fmt.Sprint(i))})
+	}
+	c.route(Message{Topic: "homeassistant/status", Payload: []byte("online")})
+	c.route(Message{Topic: "other", Payload: []byte("x")})
+
+	select {
+	case msg := <-other.Messages:
+		if string(msg.Payload) != "x" {
+			t.Errorf("got %s on the other subscription", msg.Payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the other subscription was blocked")
+	}
+	for i := 0; i < 100; i++ {
+		if msg := <-busy.Messages; string(msg.Payload) != fmt.Sprint(i) {
+			t.Fatalf("got %s, expected %d", msg.Payload, i)
+		}
+	}
+	if msg := <-busy.Messages; msg.Topic != "homeassistant/status" {
+		t.Errorf("got %s, expected the HA status", msg.Topic)
+	}
+}
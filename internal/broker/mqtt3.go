@@ -0,0 +1,95 @@
+package broker
+
+import (
+	"TeslaBle2Mqtt/internal/settings"
+	"context"
+	"path/filepath"
+
+	"github.com/charmbracelet/log"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqtt3Transport is a MQTT 3.1.1 transport using paho.mqtt.golang
+type mqtt3Transport struct {
+	client mqtt.Client
+	qos    byte
+	route  func(Message)
+}
+
+// NewClientOptions returns the options for a MQTT 3.1.1 client with the given client id, using
+// the broker, credentials and TLS configuration from settings.
+func NewClientOptions(client_id string) *mqtt.ClientOptions {
+	s := settings.Get()
+	opts := mqtt.NewClientOptions().
+		AddBroker(brokerUrl(s).String()).
+		SetUsername(s.MqttUser).
+		SetPassword(s.MqttPass).
+		SetClientID(client_id)
+	if tls_config != nil {
+		opts.SetTLSConfig(tls_config)
+	}
+	if len(s.MqttWsHeaders) > 0 {
+		opts.SetHTTPHeaders(settings.Headers(s.MqttWsHeaders))
+	}
+	return opts
+}
+
+func newMqtt3Transport(client_id string, will_topic string, c *Connection) *mqtt3Transport {
+	s := settings.Get()
+	t := &mqtt3Transport{qos: s.MqttQos, route: c.route}
+	opts := NewClientOptions(client_id).
+		SetWill(will_topic, "offline", s.MqttQos, true).
+		SetCleanSession(!s.MqttPersistentSession).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			c.onConnect()
+		}).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			c.onConnectionLost(err)
+		})
+	if s.MqttStoreDir != "" {
+		opts.SetStore(mqtt.NewFileStore(filepath.Join(s.MqttStoreDir, "session")))
+	}
+	t.client = mqtt.NewClient(opts)
+	return t
+}
+
+func (t *mqtt3Transport) connect() error {
+	token := t.client.Connect()
+	token.Wait()
+	return token.Error()
+}
+
+func (t *mqtt3Transport) close() {
+	t.client.Disconnect(250)
+}
+
+func (t *mqtt3Transport) subscribe(topics []string) error {
+	filters := make(map[string]byte, len(topics))
+	for _, topic := range topics {
+		filters[topic] = t.qos
+	}
+	token := t.client.SubscribeMultiple(filters, func(client mqtt.Client, msg mqtt.Message) {
+		t.route(Message{Topic: msg.Topic(), Payload: msg.Payload()})
+	})
+	token.Wait()
+	return token.Error()
+}
+
+func (t *mqtt3Transport) unsubscribe(topics []string) error {
+	token := t.client.Unsubscribe(topics...)
+	token.Wait()
+	return token.Error()
+}
+
+func (t *mqtt3Transport) publish(ctx context.Context, topic string, retained bool, payload []byte, props *Properties) error {
+	if props != nil {
+		log.Debug("Ignoring MQTT 5 properties with MQTT 3.1.1", "topic", topic)
+	}
+	token := t.client.Publish(topic, t.qos, retained, payload)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-token.Done():
+	}
+	return token.Error()
+}
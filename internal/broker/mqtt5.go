@@ -0,0 +1,172 @@
+package broker
+
+import (
+	"TeslaBle2Mqtt/internal/settings"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/session/state"
+	"github.com/eclipse/paho.golang/paho/store/file"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqtt5Transport is a MQTT 5 transport using paho.golang
+type mqtt5Transport struct {
+	cfg  autopaho.ClientConfig
+	cm   *autopaho.ConnectionManager
+	qos  byte
+	stop context.CancelFunc
+}
+
+// How long the broker keeps a persistent session after the connection is closed
+const sessionExpiryInterval = 24 * 60 * 60 // seconds
+
+func newMqtt5Transport(client_id string, will_topic string, c *Connection) (*mqtt5Transport, error) {
+	s := settings.Get()
+	t := &mqtt5Transport{qos: s.MqttQos}
+
+	t.cfg = autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{brokerUrl(s)},
+		TlsCfg:                        tls_config,
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: !s.MqttPersistentSession,
+		ConnectUsername:               s.MqttUser,
+		ConnectPassword:               []byte(s.MqttPass),
+		WillMessage: &paho.WillMessage{
+			Topic:   will_topic,
+			Payload: []byte("offline"),
+			QoS:     s.MqttQos,
+			Retain:  true,
+		},
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, connack *paho.Connack) {
+			c.onConnect()
+		},
+		OnConnectError: func(err error) {
+			c.onConnectionLost(err)
+		},
+		// Reuse the paho.mqtt.golang loggers, they are set up with --mqtt-debug
+		Debug:      mqtt.DEBUG,
+		Errors:     mqtt.ERROR,
+		PahoDebug:  mqtt.DEBUG,
+		PahoErrors: mqtt.ERROR,
+		ClientConfig: paho.ClientConfig{
+			ClientID: client_id,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(pr paho.PublishReceived) (bool, error) {
+					msg := Message{Topic: pr.Packet.Topic, Payload: pr.Packet.Payload}
+					if pr.Packet.Properties != nil {
+						msg.ResponseTopic = pr.Packet.Properties.ResponseTopic
+						msg.CorrelationData = pr.Packet.Properties.CorrelationData
+					}
+					c.route(msg)
+					return true, nil
+				},
+			},
+			OnClientError: func(err error) {
+				c.onConnectionLost(err)
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				c.onConnectionLost(fmt.Errorf("server disconnected (reason code %d)", d.ReasonCode))
+			},
+		},
+	}
+	if s.MqttPersistentSession {
+		t.cfg.SessionExpiryInterval = sessionExpiryInterval
+	}
+	if s.MqttStoreDir != "" {
+		session_dir := filepath.Join(s.MqttStoreDir, "session")
+		if err := os.MkdirAll(session_dir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create MQTT session store: %w", err)
+		}
+		client_store, err := file.New(session_dir, "client_", ".pkt")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create MQTT session store: %w", err)
+		}
+		server_store, err := file.New(session_dir, "server_", ".pkt")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create MQTT session store: %w", err)
+		}
+		t.cfg.Session = state.New(client_store, server_store)
+	}
+	if len(s.MqttWsHeaders) > 0 {
+		t.cfg.WebSocketCfg = &autopaho.WebSocketConfig{
+			Header: func(url *url.URL, tlsCfg *tls.Config) http.Header {
+				return settings.Headers(s.MqttWsHeaders)
+			},
+		}
+	}
+	return t, nil
+}
+
+func (t *mqtt5Transport) connect() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cm, err := autopaho.NewConnection(ctx, t.cfg)
+	if err != nil {
+		cancel()
+		return err
+	}
+	t.cm = cm
+	t.stop = cancel
+
+	// autopaho retries forever, give up on the first connection after a while
+	await_ctx, await_cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer await_cancel()
+	if err := cm.AwaitConnection(await_ctx); err != nil {
+		cancel()
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	return nil
+}
+
+func (t *mqtt5Transport) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	_ = t.cm.Disconnect(ctx)
+	t.stop()
+}
+
+func (t *mqtt5Transport) subscribe(topics []string) error {
+	subscriptions := make([]paho.SubscribeOptions, len(topics))
+	for i, topic := range topics {
+		subscriptions[i] = paho.SubscribeOptions{Topic: topic, QoS: t.qos}
+	}
+	_, err := t.cm.Subscribe(context.Background(), &paho.Subscribe{Subscriptions: subscriptions})
+	return err
+}
+
+func (t *mqtt5Transport) unsubscribe(topics []string) error {
+	_, err := t.cm.Unsubscribe(context.Background(), &paho.Unsubscribe{Topics: topics})
+	return err
+}
+
+func (t *mqtt5Transport) publish(ctx context.Context, topic string, retained bool, payload []byte, props *Properties) error {
+	publish := &paho.Publish{
+		QoS:     t.qos,
+		Retain:  retained,
+		Topic:   topic,
+		Payload: payload,
+	}
+	if props != nil {
+		publish.Properties = &paho.PublishProperties{
+			CorrelationData: props.CorrelationData,
+			ContentType:     props.ContentType,
+		}
+		if props.MessageExpiry > 0 {
+			expiry := uint32(props.MessageExpiry.Seconds())
+			publish.Properties.MessageExpiry = &expiry
+		}
+		for key, value := range props.User {
+			publish.Properties.User.Add(key, value)
+		}
+	}
+	_, err := t.cm.Publish(ctx, publish)
+	return err
+}
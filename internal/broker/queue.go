@@ -0,0 +1,133 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// DropPolicy decides which message is dropped when the offline queue is full
+type DropPolicy string
+
+const (
+	// Drop the oldest message in the queue
+	DropOldest DropPolicy = "drop-oldest"
+	// Drop the new message
+	DropNewest DropPolicy = "drop-newest"
+	// Only keep the latest message per topic, drop the oldest message if the queue is still full
+	Coalesce DropPolicy = "coalesce"
+)
+
+var DropPolicies = []DropPolicy{DropOldest, DropNewest, Coalesce}
+
+// queuedMessage is a publish that could not be sent while the broker was unreachable
+type queuedMessage struct {
+	// Identifies the message while it is replayed, as pushes can drop messages meanwhile
+	Id         uint64      `json:"id"`
+	Topic      string      `json:"topic"`
+	Payload    []byte      `json:"payload"`
+	Retained   bool        `json:"retained"`
+	Properties *Properties `json:"properties,omitempty"`
+	Queued     time.Time   `json:"queued"`
+}
+
+// offlineQueue is a bounded FIFO of messages, optionally persisted to a file so it survives restarts
+type offlineQueue struct {
+	path     string
+	size     int
+	policy   DropPolicy
+	messages []queuedMessage
+	next_id  uint64
+}
+
+func newOfflineQueue(path string, size int, policy DropPolicy) (*offlineQueue, error) {
+	q := &offlineQueue{
+		path:   path,
+		size:   size,
+		policy: policy,
+	}
+	if path == "" {
+		return q, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read offline queue: %w", err)
+	}
+	if err := json.Unmarshal(data, &q.messages); err != nil {
+		return nil, fmt.Errorf("failed to parse offline queue (%s): %w", path, err)
+	}
+	// The size could have been reduced since the queue was saved
+	if over := len(q.messages) - q.size; over > 0 {
+		q.messages = q.messages[over:]
+	}
+	for i := range q.messages {
+		q.messages[i].Id = uint64(i)
+	}
+	q.next_id = uint64(len(q.messages))
+	return q, nil
+}
+
+func (q *offlineQueue) len() int {
+	return len(q.messages)
+}
+
+// push adds a message to the queue, returns true if a message had to be dropped
+func (q *offlineQueue) push(msg queuedMessage) (bool, error) {
+	if q.policy == Coalesce {
+		// Only the latest message of a topic matters
+		q.messages = slices.DeleteFunc(q.messages, func(m queuedMessage) bool { return m.Topic == msg.Topic })
+	}
+	dropped := len(q.messages) >= q.size
+	if dropped {
+		if q.policy == DropNewest {
+			return true, nil
+		}
+		q.messages = q.messages[len(q.messages)-q.size+1:]
+	}
+	msg.Id = q.next_id
+	q.next_id++
+	q.messages = append(q.messages, msg)
+	return dropped, q.save()
+}
+
+func (q *offlineQueue) peek() (queuedMessage, bool) {
+	if len(q.messages) == 0 {
+		return queuedMessage{}, false
+	}
+	return q.messages[0], true
+}
+
+// remove removes the message with the given id, unless a push dropped it already
+func (q *offlineQueue) remove(id uint64) error {
+	i := slices.IndexFunc(q.messages, func(m queuedMessage) bool { return m.Id == id })
+	if i == -1 {
+		return nil
+	}
+	q.messages = slices.Delete(q.messages, i, i+1)
+	return q.save()
+}
+
+// save writes the queue to disk, the file is replaced atomically
+func (q *offlineQueue) save() error {
+	if q.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(q.messages)
+	if err != nil {
+		return err
+	}
+	tmp_path := q.path + ".tmp"
+	if err := os.WriteFile(tmp_path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write offline queue: %w", err)
+	}
+	if err := os.Rename(tmp_path, filepath.Clean(q.path)); err != nil {
+		return fmt.Errorf("failed to write offline queue: %w", err)
+	}
+	return nil
+}
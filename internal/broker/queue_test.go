@@ -0,0 +1,159 @@
+package broker
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// queued returns the queue as topic=payload strings, oldest first
+func queued(q *offlineQueue) []string {
+	var out []string
+	for _, m := range q.messages {
+		out = append(out, m.Topic+"="+string(m.Payload))
+	}
+	return out
+}
+
+// pushAll pushes topic=payload messages and returns how many were dropped
+func pushAll(t *testing.T, q *offlineQueue, messages []string) int {
+	dropped := 0
+	for _, m := range messages {
+		topic, payload, _ := strings.Cut(m, "=")
+		d, err := q.push(queuedMessage{Topic: topic, Payload: []byte(payload)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d {
+			dropped++
+		}
+	}
+	return dropped
+}
+
+func TestQueueDropPolicies(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  DropPolicy
+		size    int
+		push    []string
+		want    []string
+		dropped int
+	}{
+		{"drop-oldest not full", DropOldest, 3, []string{"a=1", "b=1"}, []string{"a=1", "b=1"}, 0},
+		{"drop-oldest", DropOldest, 3, []string{"a=1", "b=1", "c=1", "d=1", "e=1"}, []string{"c=1", "d=1", "e=1"}, 2},
+		{"drop-oldest same topic", DropOldest, 2, []string{"a=1", "a=2", "a=3"}, []string{"a=2", "a=3"}, 1},
+		{"drop-newest not full", DropNewest, 3, []string{"a=1", "b=1"}, []string{"a=1", "b=1"}, 0},
+		{"drop-newest", DropNewest, 3, []string{"a=1", "b=1", "c=1", "d=1", "e=1"}, []string{"a=1", "b=1", "c=1"}, 2},
+		{"coalesce same topic", Coalesce, 3, []string{"a=1", "b=1", "a=2", "a=3"}, []string{"b=1", "a=3"}, 0},
+		{"coalesce full", Coalesce, 2, []string{"a=1", "b=1", "c=1"}, []string{"b=1", "c=1"}, 1},
+		{"coalesce full same topic", Coalesce, 2, []string{"a=1", "b=1", "b=2"}, []string{"a=1", "b=2"}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q, err := newOfflineQueue("", test.size, test.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dropped := pushAll(t, q, test.push); dropped != test.dropped {
+				t.Errorf("dropped %d, expected %d", dropped, test.dropped)
+			}
+			if got := queued(q); !slices.Equal(got, test.want) {
+				t.Errorf("got %v, expected %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestQueueRemove(t *testing.T) {
+	q, _ := newOfflineQueue("", 3, DropOldest)
+	pushAll(t, q, []string{"a=1", "b=1"})
+	for _, want := range []string{"a", "b"} {
+		msg, ok := q.peek()
+		if !ok || msg.Topic != want {
+			t.Fatalf("peeked %v, %v, expected %s", msg.Topic, ok, want)
+		}
+		if err := q.remove(msg.Id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := q.peek(); ok || q.len() != 0 {
+		t.Errorf("expected an empty queue, got %v", queued(q))
+	}
+}
+
+// A message that is being replayed can be dropped by a push, removing it afterwards must not
+// remove another message
+func TestQueueRemoveDropped(t *testing.T) {
+	tests := []struct {
+		policy DropPolicy
+		push   []string
+		want   []string
+	}{
+		{DropOldest, []string{"c=1"}, []string{"b=1", "c=1"}},
+		{Coalesce, []string{"a=2"}, []string{"b=1", "a=2"}},
+	}
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			q, _ := newOfflineQueue("", 2, test.policy)
+			pushAll(t, q, []string{"a=1", "b=1"})
+			replaying, _ := q.peek()
+			pushAll(t, q, test.push)
+			if err := q.remove(replaying.Id); err != nil {
+				t.Fatal(err)
+			}
+			if got := queued(q); !slices.Equal(got, test.want) {
+				t.Errorf("got %v, expected %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestQueuePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	q, err := newOfflineQueue(path, 3, DropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushAll(t, q, []string{"a=1", "b=1", "c=1"})
+	if msg, _ := q.peek(); q.remove(msg.Id) != nil {
+		t.Fatal("failed to remove the first message")
+	}
+
+	q, err = newOfflineQueue(path, 3, DropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := queued(q); !slices.Equal(got, []string{"b=1", "c=1"}) {
+		t.Errorf("got %v after reload", got)
+	}
+
+	// The oldest messages are dropped if the size was reduced since
+	q, err = newOfflineQueue(path, 1, DropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := queued(q); !slices.Equal(got, []string{"c=1"}) {
+		t.Errorf("got %v after reload with a smaller size", got)
+	}
+}
+
+func TestQueueIdsAfterReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	q, _ := newOfflineQueue(path, 3, DropOldest)
+	pushAll(t, q, []string{"a=1", "b=1"})
+
+	q, err := newOfflineQueue(path, 3, DropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushAll(t, q, []string{"c=1"})
+	ids := map[uint64]bool{}
+	for _, m := range q.messages {
+		ids[m.Id] = true
+	}
+	if len(ids) != 3 {
+		t.Errorf("expected unique ids, got %+v", q.messages)
+	}
+}
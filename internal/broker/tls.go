@@ -0,0 +1,46 @@
+package broker
+
+import (
+	"TeslaBle2Mqtt/internal/settings"
+	"crypto/tls"
+	"fmt"
+)
+
+// usesTls returns true if any of the MQTT TLS settings are set
+func usesTls(s *settings.Settings) bool {
+	return s.MqttTls || s.MqttCaFile != "" || s.MqttCertFile != "" || s.MqttKeyFile != "" || s.MqttInsecure || s.MqttServerName != ""
+}
+
+// loadTlsConfig builds the TLS configuration used for the MQTT broker connection from settings.
+// Returns nil if TLS is not enabled.
+func loadTlsConfig(s *settings.Settings) (*tls.Config, error) {
+	if !usesTls(s) {
+		return nil, nil
+	}
+
+	tls_config := &tls.Config{
+		InsecureSkipVerify: s.MqttInsecure,
+		ServerName:         s.MqttServerName,
+	}
+
+	if s.MqttCaFile != "" {
+		pool, err := settings.LoadCaFile(s.MqttCaFile, "MQTT")
+		if err != nil {
+			return nil, err
+		}
+		tls_config.RootCAs = pool
+	}
+
+	if s.MqttCertFile != "" || s.MqttKeyFile != "" {
+		if s.MqttCertFile == "" || s.MqttKeyFile == "" {
+			return nil, fmt.Errorf("both MQTT client certificate and key must be set")
+		}
+		cert, err := tls.LoadX509KeyPair(s.MqttCertFile, s.MqttKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load MQTT client certificate: %w", err)
+		}
+		tls_config.Certificates = []tls.Certificate{cert}
+	}
+
+	return tls_config, nil
+}
@@ -5,34 +5,22 @@ import (
 	_ "embed"
 	"encoding/json"
 	"fmt"
-	"os"
 	"strings"
 
 	"github.com/charmbracelet/log"
-	"gopkg.in/yaml.v3"
 )
 
 //go:embed mqtt_sensors.yaml
 var default_config []byte
 
-func loadYamlFile(filename string) (map[string]interface{}, error) {
-	var file_data []byte
-	if filename == "" {
-		file_data = default_config
-		log.Debug("Using default sensors configuration")
-	} else {
-		var err error
-		file_data, err = os.ReadFile(filename)
-		if err != nil {
-			return nil, err
-		}
-		log.Debug("Using sensors configuration from", "filename", filename)
+func loadYamlFile(filename string, overlays []string) (map[string]interface{}, error) {
+	node, err := loadSensorsNode(filename, overlays, nil)
+	if err != nil {
+		return nil, err
 	}
 
 	sensors_config := make(map[string]interface{})
-	err := yaml.Unmarshal(file_data, &sensors_config)
-
-	if err != nil {
+	if err := node.Decode(&sensors_config); err != nil {
 		return nil, err
 	}
 	return sensors_config, nil
@@ -56,6 +44,19 @@ func parseSubCommand(command string) (SubCommand, error) {
 	return cmd, nil
 }
 
+// parseStateBindings parses every publish binding, so they are not parsed again on every poll
+func parseStateBindings(pub DevicePublishBindings) (map[ha_discovery.Topic]ha_discovery.StateBinding, error) {
+	bindings := make(map[ha_discovery.Topic]ha_discovery.StateBinding, len(pub))
+	for topic, binding := range pub {
+		state_binding, err := ha_discovery.ParseStateBinding(binding)
+		if err != nil {
+			return nil, fmt.Errorf("invalid state binding for topic `%s`: %w", topic, err)
+		}
+		bindings[topic] = state_binding
+	}
+	return bindings, nil
+}
+
 type DeviceType string
 
 const (
@@ -75,10 +76,14 @@ type DeviceDiscovery struct {
 type DiscoveryHandler struct {
 	Discovery         DeviceDiscovery
 	Vin               string
-	ClientId          string
-	WillTopic         string
+	Id                string
+	StatusTopic       string
 	PublishBindings   DevicePublishBindings
 	SubscribeBindings DeviceSubscribeBindings
+	// Publish bindings parsed into their access path and transforms (or template), by topic
+	StateBindings map[ha_discovery.Topic]ha_discovery.StateBinding
+	// Endpoints requested from vehicle_data, derived from the publish bindings
+	VehicleDataEndpoints []string
 }
 
 type DiscoverySettings struct {
@@ -87,7 +92,10 @@ type DiscoverySettings struct {
 	Vins             []string
 	Version          string
 	ConfigurationUrl string
-	MaxChargingAmps  string
+	// Per vehicle replacement values, they override the default replacements
+	VinReplacements map[string]map[string]string
+	// Files deep merged onto the sensors configuration, in order
+	SensorsOverlays []string
 }
 
 func vehicleModel(vin byte) string {
@@ -112,8 +120,28 @@ func vehicleModel(vin byte) string {
 	}
 }
 
+// Replacements returns the values replacing `key` in the sensors configuration, those of the handler
+// device if vin is empty, otherwise those of the vehicle with its VinReplacements overrides
+func Replacements(settings DiscoverySettings, vin string) map[string]string {
+	replacements := map[string]string{
+		"mqtt_prefix":            settings.MqttPrefix,
+		"tb2m_version":           settings.Version,
+		"tb2m_configuration_url": settings.ConfigurationUrl,
+	}
+	if vin == "" {
+		return replacements
+	}
+	replacements["vin"] = vin
+	replacements["vehicle_model"] = vehicleModel(vin[3])
+	replacements["vehicle_name"] = "Tesla " + vehicleModel(vin[3])
+	for key, value := range settings.VinReplacements[vin] {
+		replacements[key] = value
+	}
+	return replacements
+}
+
 func GetDiscovery(filename string, settings DiscoverySettings) ([]DiscoveryHandler, error) {
-	sensors_config, err := loadYamlFile(filename)
+	sensors_config, err := loadYamlFile(filename, settings.SensorsOverlays)
 	if err != nil {
 		return nil, err
 	}
@@ -149,7 +177,7 @@ func GetDiscovery(filename string, settings DiscoverySettings) ([]DiscoveryHandl
 		return disc, pub, sub_cmd, nil
 	}
 
-	addDevice := func(device *map[string]interface{}, vin string, clientId string, discovery_topic string, will_topic string, device_type DeviceType, replacements map[string]string) error {
+	addDevice := func(device *map[string]interface{}, vin string, id string, discovery_topic string, status_topic string, device_type DeviceType, replacements map[string]string) error {
 		disc, pub, sub, err := parseDeviceWithPubSub(device, replacements)
 		if err != nil {
 			return err
@@ -158,32 +186,31 @@ func GetDiscovery(filename string, settings DiscoverySettings) ([]DiscoveryHandl
 		if err != nil {
 			return err
 		}
+		state_bindings, err := parseStateBindings(pub)
+		if err != nil {
+			return err
+		}
+		var endpoints []string
+		if device_type == PerVehicleDeviceType {
+			endpoints = vehicleDataEndpoints(pub)
+		}
 		discoveries = append(discoveries, DiscoveryHandler{
 			Discovery: DeviceDiscovery{
 				Topic:      discovery_topic,
 				DeviceType: device_type,
 				Message:    disc_json,
 			},
-			Vin:               vin,
-			ClientId:          clientId,
-			WillTopic:         will_topic,
-			PublishBindings:   pub,
-			SubscribeBindings: sub,
+			Vin:                  vin,
+			Id:                   id,
+			StatusTopic:          status_topic,
+			PublishBindings:      pub,
+			SubscribeBindings:    sub,
+			StateBindings:        state_bindings,
+			VehicleDataEndpoints: endpoints,
 		})
 		return nil
 	}
 
-	vinReplacements := func(vin string) map[string]string {
-		return map[string]string{
-			"vin":                    vin,
-			"mqtt_prefix":            settings.MqttPrefix,
-			"tb2m_version":           settings.Version,
-			"tb2m_configuration_url": settings.ConfigurationUrl,
-			"vehicle_model":          vehicleModel(vin[3]),
-			"max_charging_amps":      settings.MaxChargingAmps,
-		}
-	}
-
 	handler, ok := devices["handler"].(map[string]interface{})
 	if !ok {
 		return nil, fmt.Errorf("handler not found or invalid in %s", filename)
@@ -193,7 +220,7 @@ func GetDiscovery(filename string, settings DiscoverySettings) ([]DiscoveryHandl
 		return nil, fmt.Errorf("handler_vin_components not found or invalid in %s", filename)
 	}
 	for _, vin := range settings.Vins {
-		comp_disc, _, _, err := parseDeviceWithPubSub(&handler_vin_components, vinReplacements(vin))
+		comp_disc, _, _, err := parseDeviceWithPubSub(&handler_vin_components, Replacements(settings, vin))
 		// TODO: Do not ignore publish and subscribe bindings
 		if err != nil {
 			return nil, err
@@ -213,11 +240,7 @@ func GetDiscovery(filename string, settings DiscoverySettings) ([]DiscoveryHandl
 
 	if err := addDevice(&handler, "tb2m", settings.MqttPrefix, discoveryTopic(settings.MqttPrefix),
 		fmt.Sprintf("%s/status", settings.MqttPrefix),
-		HandlerDeviceType, map[string]string{
-			"mqtt_prefix":            settings.MqttPrefix,
-			"tb2m_version":           settings.Version,
-			"tb2m_configuration_url": settings.ConfigurationUrl,
-		}); err != nil {
+		HandlerDeviceType, Replacements(settings, "")); err != nil {
 		return nil, err
 	}
 
@@ -227,10 +250,10 @@ func GetDiscovery(filename string, settings DiscoverySettings) ([]DiscoveryHandl
 	}
 
 	for _, vin := range settings.Vins {
-		clientId := fmt.Sprintf("%s_%s", settings.MqttPrefix, vin)
-		if err := addDevice(&per_vehicle, vin, clientId, discoveryTopic(clientId),
+		id := fmt.Sprintf("%s_%s", settings.MqttPrefix, vin)
+		if err := addDevice(&per_vehicle, vin, id, discoveryTopic(id),
 			fmt.Sprintf("%s/%s/status", settings.MqttPrefix, vin), PerVehicleDeviceType,
-			vinReplacements(vin)); err != nil {
+			Replacements(settings, vin)); err != nil {
 			return nil, err
 		}
 	}
@@ -0,0 +1,26 @@
+package discovery
+
+import (
+	"regexp"
+	"slices"
+)
+
+// Always requested, the charging poll interval depends on it
+const chargeStateEndpoint = "charge_state"
+
+// Matches access paths (also inside __template) into vehicle_data
+var vehicleDataPathPattern = regexp.MustCompile(`\bvehicle_data\.([a-z_]+)`)
+
+// vehicleDataEndpoints returns the vehicle_data endpoints used by the publish bindings, in order
+func vehicleDataEndpoints(pub DevicePublishBindings) []string {
+	endpoints := []string{chargeStateEndpoint}
+	for _, binding := range pub {
+		for _, match := range vehicleDataPathPattern.FindAllStringSubmatch(binding, -1) {
+			if !slices.Contains(endpoints, match[1]) {
+				endpoints = append(endpoints, match[1])
+			}
+		}
+	}
+	slices.Sort(endpoints)
+	return endpoints
+}
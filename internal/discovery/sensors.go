@@ -0,0 +1,175 @@
+package discovery
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/charmbracelet/log"
+	"gopkg.in/yaml.v3"
+)
+
+// Nested `!include` files deeper than this are assumed to include each other
+const maxIncludeDepth = 10
+
+// nodeSources records the file each node was read from, so validation errors can name it
+type nodeSources map[*yaml.Node]string
+
+// mark records filename as the source of node and of its children that do not have one yet
+func (s nodeSources) mark(node *yaml.Node, filename string) {
+	if s == nil {
+		return
+	}
+	if _, ok := s[node]; !ok {
+		s[node] = filename
+	}
+	for _, child := range node.Content {
+		s.mark(child, filename)
+	}
+}
+
+// parseYamlNode parses a YAML document and resolves its `!include` tags relative to dir. If
+// sources is set, it records filename as the source of every node not read from an included file.
+func parseYamlNode(data []byte, filename string, dir string, depth int, sources nodeSources) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, fmt.Errorf("empty YAML document")
+	}
+	if err := resolveIncludes(doc.Content[0], dir, depth, sources); err != nil {
+		return nil, err
+	}
+	sources.mark(doc.Content[0], filename)
+	return doc.Content[0], nil
+}
+
+// readYamlNode reads a YAML file with its `!include` tags resolved
+func readYamlNode(filename string, depth int, sources nodeSources) (*yaml.Node, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	node, err := parseYamlNode(data, filename, filepath.Dir(filename), depth, sources)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return node, nil
+}
+
+// resolveIncludes replaces every `!include path` node with the content of that file
+func resolveIncludes(node *yaml.Node, dir string, depth int, sources nodeSources) error {
+	if node.Tag == "!include" {
+		if depth >= maxIncludeDepth {
+			return fmt.Errorf("line %d: too many nested includes (%s)", node.Line, node.Value)
+		}
+		if node.Kind != yaml.ScalarNode {
+			return fmt.Errorf("line %d: !include expects a file name", node.Line)
+		}
+		filename := node.Value
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(dir, filename)
+		}
+		included, err := readYamlNode(filename, depth+1, sources)
+		if err != nil {
+			return fmt.Errorf("line %d: failed to include: %w", node.Line, err)
+		}
+		*node = *included
+		if sources != nil {
+			sources[node] = sources[included]
+		}
+		return nil
+	}
+	for _, child := range node.Content {
+		if err := resolveIncludes(child, dir, depth, sources); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isDeleteMarker reports if an overlay value is `{__delete: true}`
+func isDeleteMarker(node *yaml.Node) bool {
+	_, value := mappingValue(node, "__delete")
+	return value != nil && value.Value == "true"
+}
+
+// mergeNodes deep merges an overlay mapping onto a base mapping. Mappings are merged key by key,
+// anything else replaces the base value, and `__delete: true` removes the key from the base.
+func mergeNodes(base *yaml.Node, overlay *yaml.Node) error {
+	if base.Kind != yaml.MappingNode || overlay.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: can only merge an object onto an object", overlay.Line)
+	}
+	for i := 0; i+1 < len(overlay.Content); i += 2 {
+		key, value := overlay.Content[i], overlay.Content[i+1]
+		index := -1
+		for j := 0; j+1 < len(base.Content); j += 2 {
+			if base.Content[j].Value == key.Value {
+				index = j
+				break
+			}
+		}
+
+		if isDeleteMarker(value) {
+			if index != -1 {
+				base.Content = append(base.Content[:index], base.Content[index+2:]...)
+			}
+		} else if index == -1 {
+			base.Content = append(base.Content, key, value)
+		} else if base.Content[index+1].Kind == yaml.MappingNode && value.Kind == yaml.MappingNode {
+			if err := mergeNodes(base.Content[index+1], value); err != nil {
+				return err
+			}
+		} else {
+			base.Content[index+1] = value
+		}
+	}
+	return nil
+}
+
+// loadSensorsNode reads the sensors configuration (the default one if filename is empty), with
+// `!include` resolved and every overlay merged on top in order. If sources is set, it records the
+// file of every node (empty for the default configuration).
+func loadSensorsNode(filename string, overlays []string, sources nodeSources) (*yaml.Node, error) {
+	var node *yaml.Node
+	var err error
+	if filename == "" {
+		log.Debug("Using default sensors configuration")
+		node, err = parseYamlNode(default_config, "", ".", 0, sources)
+	} else {
+		log.Debug("Using sensors configuration from", "filename", filename)
+		node, err = readYamlNode(filename, 0, sources)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, overlay := range overlays {
+		log.Debug("Merging sensors overlay", "filename", overlay)
+		overlay_node, err := readYamlNode(overlay, 0, sources)
+		if err != nil {
+			return nil, err
+		}
+		if err := mergeNodes(node, overlay_node); err != nil {
+			return nil, fmt.Errorf("%s: %w", overlay, err)
+		}
+	}
+	return node, nil
+}
+
+// EffectiveSensorsYaml returns the sensors configuration as it is used, after includes and overlays
+func EffectiveSensorsYaml(filename string, overlays []string) ([]byte, error) {
+	node, err := loadSensorsNode(filename, overlays, nil)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(node); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,198 @@
+package discovery
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func testdata(name string) string {
+	return filepath.Join("testdata", "sensors", name)
+}
+
+// nodeAt returns the value at a path of mapping keys
+func nodeAt(node *yaml.Node, keys ...string) *yaml.Node {
+	for _, key := range keys {
+		_, node = mappingValue(node, key)
+	}
+	return node
+}
+
+func TestLoadSensorsNode(t *testing.T) {
+	tests := []struct {
+		name     string
+		overlays []string
+		want     string
+	}{
+		{
+			name: "includes",
+			want: `
+devices:
+  handler:
+    name: Handler
+    components:
+      uptime: {platform: sensor, icon: "mdi:clock"}
+      status: {platform: binary_sensor, icon: "mdi:check"}
+  per_vehicle:
+    components:
+      battery: {platform: sensor, unit_of_measurement: "%"}
+      old: {platform: sensor}
+`,
+		},
+		{
+			name:     "overlay",
+			overlays: []string{testdata("overlay.yaml")},
+			want: `
+devices:
+  handler:
+    name: Renamed
+    components:
+      uptime: {platform: sensor, icon: "mdi:timer"}
+      status: {platform: binary_sensor, icon: "mdi:check"}
+      added: {platform: sensor, icon: "mdi:plus"}
+  per_vehicle:
+    components:
+      battery: {platform: sensor, unit_of_measurement: kWh}
+`,
+		},
+		{
+			name:     "overlay applied twice",
+			overlays: []string{testdata("overlay.yaml"), testdata("overlay.yaml")},
+			want: `
+devices:
+  handler:
+    name: Renamed
+    components:
+      uptime: {platform: sensor, icon: "mdi:timer"}
+      status: {platform: binary_sensor, icon: "mdi:check"}
+      added: {platform: sensor, icon: "mdi:plus"}
+  per_vehicle:
+    components:
+      battery: {platform: sensor, unit_of_measurement: kWh}
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node, err := loadSensorsNode(testdata("base.yaml"), test.overlays, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, want map[string]any
+			if err := node.Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if err := yaml.Unmarshal([]byte(test.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, expected %v", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadSensorsNodeErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		overlays []string
+		err      string
+	}{
+		{name: "cyclic include", filename: "cycle_a.yaml", err: "too many nested includes"},
+		{name: "missing include", filename: "missing_include.yaml", err: "line 1: failed to include"},
+		{name: "include without file name", filename: "include_mapping.yaml", err: "!include expects a file name"},
+		{name: "missing file", filename: "missing.yaml", err: "no such file"},
+		{name: "list overlay", filename: "base.yaml", overlays: []string{"list.yaml"}, err: "can only merge an object onto an object"},
+		{name: "cyclic include in overlay", filename: "base.yaml", overlays: []string{"cycle_a.yaml"}, err: "too many nested includes"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			overlays := []string{}
+			for _, overlay := range test.overlays {
+				overlays = append(overlays, testdata(overlay))
+			}
+			_, err := loadSensorsNode(testdata(test.filename), overlays, nil)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestNodeSources(t *testing.T) {
+	sources := make(nodeSources)
+	root, err := loadSensorsNode(testdata("base.yaml"), []string{testdata("overlay.yaml")}, sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path []string
+		file string
+	}{
+		{[]string{"devices", "handler"}, "base.yaml"},
+		{[]string{"devices", "handler", "name"}, "overlay.yaml"},
+		{[]string{"devices", "handler", "components", "uptime", "platform"}, "base.yaml"},
+		{[]string{"devices", "handler", "components", "uptime", "icon"}, "overlay.yaml"},
+		{[]string{"devices", "handler", "components", "status"}, "status.yaml"},
+		{[]string{"devices", "handler", "components", "status", "platform"}, "status.yaml"},
+		{[]string{"devices", "handler", "components", "status", "icon"}, "icon.yaml"},
+		{[]string{"devices", "handler", "components", "added", "icon"}, "added.yaml"},
+		{[]string{"devices", "per_vehicle", "components", "battery", "unit_of_measurement"}, "overlay.yaml"},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.path, "."), func(t *testing.T) {
+			node := nodeAt(root, test.path...)
+			if node == nil {
+				t.Fatal("not found")
+			}
+			if file := sources[node]; file != testdata(test.file) {
+				t.Errorf("got %q, expected %q", file, testdata(test.file))
+			}
+		})
+	}
+
+	// Nodes of the default configuration have no file
+	sources = make(nodeSources)
+	root, err = loadSensorsNode("", nil, sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file, ok := sources[nodeAt(root, "devices", "handler")]; !ok || file != "" {
+		t.Errorf("got %q, %v for the default configuration", file, ok)
+	}
+}
+
+func TestValidateFiles(t *testing.T) {
+	errors, err := Validate("", []string{testdata("invalid_overlay.yaml")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		file    string
+		line    int
+		message string
+	}{
+		{testdata("invalid_component.yaml"), 3, "unknown replacement `unknown`"},
+		{testdata("invalid_overlay.yaml"), 6, "duplicate unique_id ``mqtt_prefix`_uptime`, first defined at line"},
+	}
+	for _, test := range tests {
+		found := false
+		for _, e := range errors {
+			if e.File == test.file && e.Line == test.line && strings.HasPrefix(e.Message, test.message) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected %s:%d: %s, got %v", test.file, test.line, test.message, errors)
+		}
+	}
+	for _, e := range errors {
+		if strings.Contains(e.Message, "first defined") && !strings.HasSuffix(e.Message, "of the default configuration") {
+			t.Errorf("expected the first definition in the default configuration, got %s", e.Message)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package discovery
+
+import (
+	"TeslaBle2Mqtt/pkg/ha_discovery"
+	_ "embed"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed proxy_schema.yaml
+var proxy_schema_yaml []byte
+
+// Commands accepted by the proxy on /api/1/vehicles/{vin}/command/{command}, along with wake_up and
+// clear_error which are handled separately
+var proxyCommands = []string{
+	"wake_up",
+	"clear_error",
+	"actuate_trunk",
+	"add_charge_schedule",
+	"add_precondition_schedule",
+	"adjust_volume",
+	"auto_conditioning_start",
+	"auto_conditioning_stop",
+	"cancel_software_update",
+	"charge_max_range",
+	"charge_port_door_close",
+	"charge_port_door_open",
+	"charge_standard",
+	"charge_start",
+	"charge_stop",
+	"door_lock",
+	"door_unlock",
+	"erase_user_data",
+	"flash_lights",
+	"guest_mode",
+	"honk_horn",
+	"media_next_fav",
+	"media_next_track",
+	"media_prev_fav",
+	"media_prev_track",
+	"media_toggle_playback",
+	"media_volume_down",
+	"media_volume_up",
+	"remote_auto_seat_climate_request",
+	"remote_auto_steering_wheel_heat_climate_request",
+	"remote_seat_cooler_request",
+	"remote_seat_heater_request",
+	"remote_start_drive",
+	"remote_steering_wheel_heat_level_request",
+	"remote_steering_wheel_heater_request",
+	"remove_charge_schedule",
+	"remove_precondition_schedule",
+	"reset_pin_to_drive_pin",
+	"reset_valet_pin",
+	"schedule_software_update",
+	"set_bioweapon_mode",
+	"set_cabin_overheat_protection",
+	"set_charge_limit",
+	"set_charging_amps",
+	"set_climate_keeper_mode",
+	"set_cop_temp",
+	"set_pin_to_drive",
+	"set_preconditioning_max",
+	"set_scheduled_charging",
+	"set_scheduled_departure",
+	"set_sentry_mode",
+	"set_temps",
+	"set_valet_mode",
+	"set_vehicle_name",
+	"speed_limit_activate",
+	"speed_limit_clear_pin",
+	"speed_limit_deactivate",
+	"speed_limit_set_limit",
+	"sun_roof_control",
+	"trigger_homelink",
+	"window_control",
+}
+
+// Fields Home Assistant requires for each component platform, besides `platform` itself
+var requiredComponentFields = map[string][]string{
+	"alarm_control_panel": {"command_topic", "state_topic"},
+	"binary_sensor":       {"state_topic"},
+	"button":              {"command_topic"},
+	"camera":              {"topic"},
+	"climate":             {},
+	"cover":               {},
+	"device_automation":   {"automation_type", "topic", "type", "subtype"},
+	"device_tracker":      {},
+	"event":               {"state_topic", "event_types"},
+	"fan":                 {"command_topic"},
+	"humidifier":          {"command_topic", "target_humidity_command_topic"},
+	"image":               {},
+	"lawn_mower":          {},
+	"light":               {"command_topic"},
+	"lock":                {"command_topic"},
+	"notify":              {"command_topic"},
+	"number":              {"command_topic"},
+	"scene":               {"command_topic"},
+	"select":              {"command_topic", "options"},
+	"sensor":              {"state_topic"},
+	"siren":               {"command_topic"},
+	"switch":              {"command_topic"},
+	"tag":                 {"topic"},
+	"text":                {"command_topic"},
+	"update":              {},
+	"vacuum":              {},
+	"valve":               {},
+	"water_heater":        {},
+}
+
+// PlaceholderVin is used to parse per vehicle devices when no real VIN is given
+const PlaceholderVin = "5YJ3E1EA1KF000000"
+
+var replacementPattern = regexp.MustCompile("`([^`]+)`")
+
+// ValidationError is a problem found in a sensors configuration
+type ValidationError struct {
+	// File the problem is in, empty for the default configuration
+	File    string
+	Line    int
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Line == 0 {
+		return e.Message
+	}
+	if e.File != "" {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+type validator struct {
+	schema  map[string]any
+	errors  []ValidationError
+	sources nodeSources
+	// Where each topic, command and unique_id was first defined
+	topics   map[string]string
+	commands map[string]string
+	ids      map[string]string
+}
+
+func (v *validator) errorf(node *yaml.Node, format string, args ...any) {
+	e := ValidationError{Message: fmt.Sprintf(format, args...)}
+	if node != nil {
+		e.File = v.sources[node]
+		e.Line = node.Line
+	}
+	v.errors = append(v.errors, e)
+}
+
+// position returns where node is defined, for messages that point to another node
+func (v *validator) position(node *yaml.Node) string {
+	if file := v.sources[node]; file != "" {
+		return fmt.Sprintf("%s:%d", file, node.Line)
+	}
+	return fmt.Sprintf("line %d of the default configuration", node.Line)
+}
+
+// mappingValue returns the key and value node of a mapping node
+func mappingValue(node *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i], node.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// checkReplacements flags unknown `replacement` keys in every key and string value below node
+func (v *validator) checkReplacements(node *yaml.Node, replacements map[string]string) {
+	if node.Kind == yaml.ScalarNode {
+		for _, match := range replacementPattern.FindAllStringSubmatch(node.Value, -1) {
+			if _, ok := replacements[match[1]]; !ok && match[1] != "int" && match[1] != "*" {
+				v.errorf(node, "unknown replacement `%s`", match[1])
+			}
+		}
+	}
+	for _, child := range node.Content {
+		v.checkReplacements(child, replacements)
+	}
+}
+
+// checkBindings checks the access paths and actions of every __get_state and __command below node
+func (v *validator) checkBindings(node *yaml.Node, root string) {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if strings.HasPrefix(key.Value, "__get_state") {
+				v.checkAccessPath(value, root)
+			} else if strings.HasPrefix(key.Value, "__command") {
+				action, _, _ := strings.Cut(value.Value, "|")
+				if !slices.Contains(proxyCommands, action) {
+					v.errorf(value, "unknown proxy command `%s`", action)
+				}
+			}
+		}
+	}
+	for _, child := range node.Content {
+		v.checkBindings(child, root)
+	}
+}
+
+// checkAccessPath checks that an access path exists in the known proxy schema
+func (v *validator) checkAccessPath(node *yaml.Node, root string) {
+	binding, err := ha_discovery.ParseStateBinding(node.Value)
+	if err != nil || binding.Template != nil {
+		return // Reported when parsing the component
+	}
+	path, err := ha_discovery.ParsePath(binding.Path)
+	if err != nil {
+		return // Reported when parsing the component
+	}
+	// Only plain keys are checked, the schema does not describe arrays
+	current, _ := v.schema[root].(map[string]any)
+	parts := path.Keys()
+	for i, part := range parts {
+		next, ok := current[part]
+		if !ok {
+			v.errorf(node, "unknown access path `%s`, `%s` has no `%s`", binding.Path, strings.Join(append([]string{root}, parts[:i]...), "."), part)
+			return
+		}
+		next_map, is_map := next.(map[string]any)
+		if !is_map && i < len(parts)-1 {
+			v.errorf(node, "unknown access path `%s`, `%s` is not an object", binding.Path, strings.Join(parts[:i+1], "."))
+			return
+		}
+		current = next_map
+	}
+}
+
+// checkComponent checks the fields and bindings of a single component
+func (v *validator) checkComponent(id *yaml.Node, comp *yaml.Node, replacements map[string]string) {
+	if comp.Kind != yaml.MappingNode {
+		v.errorf(id, "component `%s` is not an object", id.Value)
+		return
+	}
+	_, platform := mappingValue(comp, "platform")
+	if platform == nil {
+		v.errorf(id, "component `%s` is missing `platform`", id.Value)
+	} else if required, ok := requiredComponentFields[platform.Value]; !ok {
+		v.errorf(platform, "unknown platform `%s`", platform.Value)
+	} else {
+		for _, field := range required {
+			if key, _ := mappingValue(comp, field); key == nil {
+				v.errorf(id, "%s `%s` is missing required `%s`", platform.Value, id.Value, field)
+			}
+		}
+	}
+	unique_key, unique_id := mappingValue(comp, "unique_id")
+	if unique_key == nil {
+		v.errorf(id, "component `%s` is missing `unique_id`", id.Value)
+	} else if first, ok := v.ids[unique_id.Value]; ok {
+		v.errorf(unique_id, "duplicate unique_id `%s`, first defined at %s", unique_id.Value, first)
+	} else {
+		v.ids[unique_id.Value] = v.position(unique_id)
+	}
+
+	v.checkParse(id, comp, replacements)
+}
+
+// checkParse parses a device or component and checks its topics are not bound elsewhere
+func (v *validator) checkParse(at *yaml.Node, node *yaml.Node, replacements map[string]string) {
+	var config map[string]any
+	if err := node.Decode(&config); err != nil {
+		v.errorf(at, "%s", err)
+		return
+	}
+	delete(config, "components")
+	_, pub, sub, err := ha_discovery.ParseDeviceConfiguration(config, replacements)
+	if err != nil {
+		v.errorf(at, "%s", err)
+		return
+	}
+	for topic := range pub {
+		if first, ok := v.topics[topic]; ok {
+			v.errorf(at, "duplicate state topic `%s`, first defined at %s", topic, first)
+		} else {
+			v.topics[topic] = v.position(at)
+		}
+	}
+	for topic, commands := range sub {
+		for command := range commands {
+			key := topic + " " + command
+			if first, ok := v.commands[key]; ok {
+				v.errorf(at, "duplicate command `%s` on topic `%s`, first defined at %s", command, topic, first)
+			} else {
+				v.commands[key] = v.position(at)
+			}
+		}
+	}
+}
+
+// checkDevice checks a device and all of its components
+func (v *validator) checkDevice(key *yaml.Node, device *yaml.Node, root string, replacements map[string]string) {
+	if device.Kind != yaml.MappingNode {
+		v.errorf(key, "`%s` is not an object", key.Value)
+		return
+	}
+	if _, dev := mappingValue(device, "device"); dev == nil {
+		v.errorf(key, "`%s` is missing `device`", key.Value)
+	} else if ids, _ := mappingValue(dev, "identifiers"); ids == nil {
+		v.errorf(dev, "`%s.device` is missing `identifiers`", key.Value)
+	}
+	if _, origin := mappingValue(device, "origin"); origin == nil {
+		v.errorf(key, "`%s` is missing `origin`", key.Value)
+	} else if name, _ := mappingValue(origin, "name"); name == nil {
+		v.errorf(origin, "`%s.origin` is missing `name`", key.Value)
+	}
+
+	v.checkReplacements(device, replacements)
+	v.checkBindings(device, root)
+	v.checkParse(key, device, replacements)
+
+	comps_key, comps := mappingValue(device, "components")
+	if comps == nil || comps.Kind != yaml.MappingNode {
+		v.errorf(key, "`%s` is missing `components`", key.Value)
+		return
+	}
+	v.checkComponents(comps_key, comps, replacements)
+}
+
+func (v *validator) checkComponents(key *yaml.Node, comps *yaml.Node, replacements map[string]string) {
+	if comps.Kind != yaml.MappingNode {
+		v.errorf(key, "`%s` is not an object", key.Value)
+		return
+	}
+	for i := 0; i+1 < len(comps.Content); i += 2 {
+		v.checkComponent(comps.Content[i], comps.Content[i+1], replacements)
+	}
+}
+
+// Validate checks a sensors configuration (the default one if filename is empty) with its overlays,
+// without connecting anywhere. It returns every problem found, or an error if the files can not be read
+// at all. Each problem is reported in the file that defined the value (an overlay or included file).
+func Validate(filename string, overlays []string) ([]ValidationError, error) {
+	sources := make(nodeSources)
+	root, err := loadSensorsNode(filename, overlays, sources)
+	if err != nil {
+		return nil, err
+	}
+
+	v := validator{
+		sources:  sources,
+		topics:   make(map[string]string),
+		commands: make(map[string]string),
+		ids:      make(map[string]string),
+	}
+	if err := yaml.Unmarshal(proxy_schema_yaml, &v.schema); err != nil {
+		return nil, fmt.Errorf("invalid proxy schema: %w", err)
+	}
+
+	settings := DiscoverySettings{
+		DiscoveryPrefix:  "homeassistant",
+		MqttPrefix:       "tb2m",
+		Vins:             []string{PlaceholderVin},
+		Version:          "validate",
+		ConfigurationUrl: "http://localhost:8080/dashboard",
+		VinReplacements:  map[string]map[string]string{PlaceholderVin: {"max_charging_amps": "32"}},
+		SensorsOverlays:  overlays,
+	}
+	handler_replacements := Replacements(settings, "")
+	vehicle_replacements := Replacements(settings, PlaceholderVin)
+
+	devices_key, devices := mappingValue(root, "devices")
+	if devices == nil {
+		v.errorf(root, "`devices` not found")
+	} else {
+		if key, handler := mappingValue(devices, "handler"); handler == nil {
+			v.errorf(devices_key, "`devices.handler` not found")
+		} else {
+			v.checkDevice(key, handler, "handler", handler_replacements)
+		}
+		if key, comps := mappingValue(devices, "handler_vin_components"); comps == nil {
+			v.errorf(devices_key, "`devices.handler_vin_components` not found")
+		} else {
+			v.checkReplacements(comps, vehicle_replacements)
+			v.checkBindings(comps, "vehicle")
+			v.checkComponents(key, comps, vehicle_replacements)
+		}
+		if key, per_vehicle := mappingValue(devices, "per_vehicle"); per_vehicle == nil {
+			v.errorf(devices_key, "`devices.per_vehicle` not found")
+		} else {
+			v.checkDevice(key, per_vehicle, "vehicle", vehicle_replacements)
+		}
+	}
+
+	// Anything left that would still fail at startup
+	if len(v.errors) == 0 {
+		if _, err := GetDiscovery(filename, settings); err != nil {
+			v.errorf(nil, "%s", err)
+		}
+	}
+
+	sort.SliceStable(v.errors, func(i, j int) bool {
+		if v.errors[i].File != v.errors[j].File {
+			return v.errors[i].File < v.errors[j].File
+		}
+		return v.errors[i].Line < v.errors[j].Line
+	})
+	return v.errors, nil
+}
@@ -1,24 +1,27 @@
 package handler
 
 import (
+	"TeslaBle2Mqtt/internal/broker"
 	"TeslaBle2Mqtt/internal/discovery"
 	"TeslaBle2Mqtt/internal/settings"
 	"TeslaBle2Mqtt/pkg/ha_discovery"
+	"TeslaBle2Mqtt/pkg/proxyclient"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
-	"strconv"
+	"maps"
+	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/charmbracelet/log"
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
-func publishDiscovery(client mqtt.Client, discovery *discovery.DeviceDiscovery) error {
+func publishDiscovery(ctx context.Context, conn *broker.Connection, discovery *discovery.DeviceDiscovery) error {
 	s := settings.Get()
 
 	if s.ResetDiscovery {
@@ -33,11 +36,9 @@ func publishDiscovery(client mqtt.Client, discovery *discovery.DeviceDiscovery)
 			log.Error("Failed to marshal reset discovery", "error", err)
 			return err
 		}
-		token := client.Publish(discovery.Topic, s.MqttQos, false, json_bytes)
-		token.Wait()
-		if token.Error() != nil {
-			log.Error("Failed to reset discovery", "error", token.Error())
-			return token.Error()
+		if err := conn.Publish(ctx, discovery.Topic, false, json_bytes); err != nil {
+			log.Error("Failed to reset discovery", "error", err)
+			return err
 		}
 	}
 
@@ -46,16 +47,29 @@ func publishDiscovery(client mqtt.Client, discovery *discovery.DeviceDiscovery)
 	if err != nil {
 		log.Error("Failed to marshal discovery", "error", err)
 	}
-	token := client.Publish(discovery.Topic, s.MqttQos, true, json_bytes)
-	token.Wait()
-	if token.Error() != nil {
-		log.Error("Failed to publish discovery", "error", token.Error())
-		return token.Error()
+	if err := conn.Publish(ctx, discovery.Topic, true, json_bytes); err != nil {
+		log.Error("Failed to publish discovery", "error", err)
+		return err
 	}
 	return nil
 }
 
-func publishError(client mqtt.Client, vin string, err error) {
+// publishDiscoveryUpdate publishes a changed discovery, deleting the components that were removed from it
+func publishDiscoveryUpdate(ctx context.Context, conn *broker.Connection, old *discovery.DeviceDiscovery, updated *discovery.DeviceDiscovery) error {
+	update, err := ha_discovery.GenerateUpdateConfiguration(&old.Message, &updated.Message)
+	if err != nil {
+		log.Error("Failed to generate discovery update", "error", err)
+		return err
+	}
+	log.Debug("Updating discovery", "topic", updated.Topic, "len", len(update))
+	if err := conn.Publish(ctx, updated.Topic, false, []byte(update)); err != nil {
+		log.Error("Failed to update discovery", "error", err)
+		return err
+	}
+	return publishDiscovery(ctx, conn, updated)
+}
+
+func publishError(ctx context.Context, conn *broker.Connection, vin string, err error) {
 	s := settings.Get()
 	error_topic := fmt.Sprintf("%s/%s/last_error/state", s.MqttPrefix, vin)
 	error_str := ""
@@ -69,57 +83,47 @@ func publishError(client mqtt.Client, vin string, err error) {
 	} else {
 		error_str = "null"
 	}
-	token := client.Publish(error_topic, s.MqttQos, true, error_str)
-	token.Wait()
+	if err := conn.Publish(ctx, error_topic, true, error_str); err != nil {
+		log.Error("Failed to publish error", "error", err)
+	}
 }
 
-func getProxyResponse(ctx context.Context, http_client *http.Client, method string, endpoint string, body string) (map[string]interface{}, error) {
-	s := settings.Get()
-	proxy_url := fmt.Sprintf("%s%s", s.ProxyHost, endpoint)
-	log.Debug("Getting proxy response", "url", proxy_url)
-	var reader io.Reader = nil
-	if body != "" {
-		reader = strings.NewReader(body)
-	}
-	request, err := http.NewRequestWithContext(ctx, method, proxy_url, reader)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+// commandResponse is published to the response topic of a command (MQTT 5 only)
+type commandResponse struct {
+	Success    bool   `json:"success"`
+	Command    string `json:"command"`
+	Reason     string `json:"reason"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+func publishCommandResponse(ctx context.Context, conn *broker.Connection, msg *broker.Message, command string, duration time.Duration, err error) {
+	response := commandResponse{
+		Success:    err == nil,
+		Command:    command,
+		DurationMs: duration.Milliseconds(),
 	}
-	resp, err := http_client.Do(request)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+		var perr *proxyclient.Error
+		if errors.As(err, &perr) {
+			response.Reason = perr.Reason
+		} else {
+			response.Reason = err.Error()
+		}
 	}
-	defer resp.Body.Close()
-
-	var result map[string]interface{}
-	err = json.NewDecoder(resp.Body).Decode(&result)
+	json_bytes, err := json.Marshal(response)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
-	}
-	// log.Debug("Got response", "result", result)
-
-	response, ok := result["response"].(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("no response in result")
-	}
-
-	response_result, ok := response["result"].(bool)
-	if !ok {
-		return nil, fmt.Errorf("no result in response")
-	}
-
-	if !response_result {
-		return nil, fmt.Errorf("command failed: %s", response["reason"].(string))
+		log.Error("Failed to marshal command response", "error", err)
+		return
 	}
-
-	if response_response, ok := response["response"].(map[string]interface{}); ok {
-		return response_response, nil
+	if err := conn.PublishWithProperties(ctx, msg.ResponseTopic, false, json_bytes, &broker.Properties{
+		CorrelationData: msg.CorrelationData,
+		ContentType:     "application/json",
+	}); err != nil {
+		log.Error("Failed to publish command response", "topic", msg.ResponseTopic, "error", err)
 	}
-
-	return nil, nil
 }
 
-func handleCommand(ctx context.Context, vin string, http_client *http.Client, mqtt_client mqtt.Client, handler map[ha_discovery.Command]discovery.SubCommand, payload []byte) error {
+func handleCommand(ctx context.Context, vin string, proxy *proxyclient.Client, conn *broker.Connection, handler map[ha_discovery.Command]discovery.SubCommand, payload []byte) (string, error) {
 	command_key := string(payload)
 
 	var command discovery.SubCommand
@@ -127,7 +131,7 @@ func handleCommand(ctx context.Context, vin string, http_client *http.Client, mq
 	if command, ok = handler[command_key]; !ok {
 		def_handler, def := handler["*"]
 		if !def {
-			return fmt.Errorf("no handler for command `%s`", command_key)
+			return "", fmt.Errorf("no handler for command `%s`", command_key)
 		}
 		command_key = "*"
 		command = def_handler
@@ -141,31 +145,29 @@ func handleCommand(ctx context.Context, vin string, http_client *http.Client, mq
 	log.Info("Handling command", "key", command_key, "action", action, "body", body)
 
 	if action == "clear_error" {
-		publishError(mqtt_client, vin, nil)
-		return nil
+		publishError(ctx, conn, vin, nil)
+		return action, nil
 	}
 
-	endpoint := ""
+	var err error
 	// Special case for wake_up
 	if action == "wake_up" {
-		endpoint = fmt.Sprintf("/api/1/vehicles/%s/wake_up?wait=true", vin)
+		err = proxy.WakeUp(ctx, vin)
 	} else {
-		endpoint = fmt.Sprintf("/api/1/vehicles/%s/command/%s?wait=true", vin, action)
+		err = proxy.Command(ctx, vin, action, body)
 	}
-	_, err := getProxyResponse(ctx, http_client, http.MethodPost, endpoint, body)
 	if err != nil {
-		return err
+		return action, err
 	}
 	log.Debug("Command handled successfuly", "key", command_key, "action", action, "body", body)
 
-	return nil
+	return action, nil
 }
 
 var uptime_start *time.Time
 
-func getState(ctx context.Context, vin string, http_client *http.Client, device_type discovery.DeviceType, pub *discovery.DevicePublishBindings) (map[string]string, error) {
+func getState(ctx context.Context, vin string, proxy *proxyRouter, device_type discovery.DeviceType, bindings map[ha_discovery.Topic]ha_discovery.StateBinding, endpoints []string, p *publishStatePersistent) (map[string]string, map[string]any, error) {
 	state := make(map[string]any)
-	topicState := make(map[string]string)
 	if device_type == discovery.HandlerDeviceType {
 		if uptime_start == nil {
 			t0 := time.Now()
@@ -174,79 +176,106 @@ func getState(ctx context.Context, vin string, http_client *http.Client, device_
 		uptime := time.Since(*uptime_start)
 		state["status"] = "online" // Always online
 		state["uptime"] = fmt.Sprintf("%d", int(uptime.Seconds()))
+		proxies := make(map[string]any)
+		for _, host := range proxyHosts() {
+			proxies[host] = checkProxy(ctx, getProxyClient(host))
+		}
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		state["proxy"] = proxies[settings.Get().ProxyHosts[0]]
+		state["proxies"] = proxies
 	} else if device_type == discovery.PerVehicleDeviceType {
 		state["status"] = "offline"
 
 		// Get connection status
-		connection_status_url := fmt.Sprintf("/api/proxy/1/vehicles/%s/connection_status", vin)
-		connection_status, err := getProxyResponse(ctx, http_client, http.MethodGet, connection_status_url, "")
+		connection_status, err := cachedEndpoint(ctx, p, "connection_status", func() (*proxyclient.ConnectionStatus, error) {
+			return proxy.ConnectionStatus(ctx)
+		})
 		if err != nil {
-			return nil, fmt.Errorf("failed to get connection status: %w", err)
+			return nil, nil, fmt.Errorf("failed to get connection status: %w", err)
 		}
-		state["connection_status"] = connection_status
+		state["connection_status"] = connection_status.Raw()
+		state["proxy"] = map[string]any{"host": proxy.client().Host()}
 		// If the vehicle is in range, get body controller state
-		if connection_status["address"] != nil {
+		if connection_status.InRange() {
 			state["status"] = "online"
-			body_controller_state_url := fmt.Sprintf("/api/proxy/1/vehicles/%s/body_controller_state", vin)
-			body_controller_state, err := getProxyResponse(ctx, http_client, http.MethodGet, body_controller_state_url, "")
+			body_controller_state, err := cachedEndpoint(ctx, p, "body_controller_state", func() (*proxyclient.BodyControllerState, error) {
+				return proxy.client().BodyControllerState(ctx, vin)
+			})
 			if err != nil {
-				return nil, fmt.Errorf("failed to get body controller state: %w", err)
+				return nil, nil, fmt.Errorf("failed to get body controller state: %w", err)
 			}
-			state["body_controller_state"] = body_controller_state
+			state["body_controller_state"] = body_controller_state.Raw()
 			// If the vehicle is awake, get vehicle state
-			if body_controller_state["vehicle_sleep_status"] == "VEHICLE_SLEEP_STATUS_AWAKE" {
-				vehicle_state_url := fmt.Sprintf("/api/1/vehicles/%s/vehicle_data?endpoints=charge_state;climate_state", vin)
-				vehicle_state, err := getProxyResponse(ctx, http_client, http.MethodGet, vehicle_state_url, "")
-				if err != nil {
-					return nil, fmt.Errorf("failed to get vehicle state: %w", err)
-				}
-				state["vehicle_data"] = vehicle_state
-
-				if cs, ok := vehicle_state["charge_state"].(map[string]any); ok {
-					if cs["charging_state"] == "Charging" {
-						topicState["poll_interval"] = strconv.Itoa(settings.Get().PollIntervalCharging) // Special case for charging poll interval
-						log.Debug("Using charging poll interval", "vin", vin)
+			if body_controller_state.Awake() {
+				// Endpoints that are not due are reused from the cache
+				if due := p.endpoints.due(endpoints...); len(due) > 0 {
+					vehicle_data, err := proxy.client().VehicleData(ctx, vin, due)
+					if err != nil {
+						return nil, nil, fmt.Errorf("failed to get vehicle state: %w", err)
+					}
+					p.raw.publish(ctx, "vehicle_data", vehicle_data.Raw())
+					for _, endpoint := range due {
+						if response := vehicle_data.Endpoint(endpoint); response != nil {
+							p.endpoints.set(endpoint, response)
+						} else {
+							p.endpoints.set(endpoint, nil)
+						}
 					}
 				}
+				vehicle_state := p.endpoints.vehicleData(endpoints)
+				state["vehicle_data"] = vehicle_state
 			} else {
 				log.Debug("Vehicle not awake", "vin", vin)
+				p.endpoints.clear(endpoints...)
 			}
 		} else {
 			log.Debug("Vehicle not in range", "vin", vin)
+			p.endpoints.clear(append([]string{"body_controller_state"}, endpoints...)...)
 		}
+		state["freshness"] = p.endpoints.freshness()
 	} else {
 		log.Error("Invalid device type", "device_type", device_type)
-		return nil, fmt.Errorf("invalid device type")
+		return nil, nil, fmt.Errorf("invalid device type")
 	}
-	for topic, access_path := range *pub {
+	return bindState(bindings, state), state, nil
+}
+
+// bindState resolves the publish bindings against the state, returning the value of each topic
+func bindState(bindings map[ha_discovery.Topic]ha_discovery.StateBinding, state map[string]any) map[string]string {
+	topicState := make(map[string]string)
+	for topic, state_binding := range bindings {
 		value := "None"
 
-		access_path_parts := strings.Split(access_path, ".")
-		current_state := state
-		for _, part := range access_path_parts {
-			// Traverse the state object
-			if current_state == nil {
-				break
-			}
-			if next, ok := current_state[part]; ok {
-				if next_map, ok := next.(map[string]any); ok {
-					current_state = next_map
-				} else {
-					value = fmt.Sprintf("%v", next)
-					if value == "<nil>" {
-						value = "null"
-					}
-					break
-				}
-			} else {
-				break
-			}
+		if state_binding.Template != nil {
+			topicState[topic] = state_binding.Execute(state)
+			continue
+		}
+		if next, ok := state_binding.Lookup(state); ok {
+			value = formatStateValue(next)
 		}
 		// log.Debug("Processed new", "topic", topic, "access_path", access_path, "value", value)
 		topicState[topic] = value
 	}
 	topicState["status"] = state["status"].(string) // Special case for status
-	return topicState, nil
+	return topicState
+}
+
+// formatStateValue formats a state value for publishing, objects and arrays are published as JSON
+func formatStateValue(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case map[string]any, []any:
+		json_bytes, err := json.Marshal(value)
+		if err != nil {
+			return "None"
+		}
+		return string(json_bytes)
+	default:
+		return fmt.Sprintf("%v", value)
+	}
 }
 
 func isFastPollEvent(access_path, new_value string) bool {
@@ -265,219 +294,183 @@ func isFastPollEvent(access_path, new_value string) bool {
 }
 
 type publishStatePersistent struct {
-	online_hysteresis    int
-	fast_poll_start_time time.Time
-	fast_poll_interval   time.Duration
+	policy    PollPolicy
+	raw       *rawPublisher
+	endpoints *endpointScheduler
 }
 
-func publishState(ctx context.Context, vin string, http_client *http.Client, mqtt_client mqtt.Client, disc *discovery.DiscoveryHandler, old_state map[ha_discovery.Topic]string, p *publishStatePersistent, start_fast_poll bool) (time.Duration, error) {
+func publishState(ctx context.Context, vin string, proxy *proxyRouter, conn *broker.Connection, disc *discovery.DiscoveryHandler, old_state map[ha_discovery.Topic]string, p *publishStatePersistent, start_fast_poll bool) (time.Duration, error) {
 	start := time.Now()
 	s := settings.Get()
 
-	poll_interval := time.Duration(s.PollInterval) * time.Second
-	skip_publish := false
-
-	if disc.ClientId != s.MqttPrefix {
-		log.Debug("Getting state", "handler", disc.ClientId)
+	if disc.Id != s.MqttPrefix {
+		log.Debug("Getting state", "handler", disc.Id)
 	}
-	state, err := getState(ctx, vin, http_client, disc.Discovery.DeviceType, &disc.PublishBindings)
+	if start_fast_poll {
+		// A command was sent, do not show cached data that it might have changed
+		p.endpoints.clear()
+	}
+	state, polled_state, err := getState(ctx, vin, proxy, disc.Discovery.DeviceType, disc.StateBindings, disc.VehicleDataEndpoints, p)
 	// log.Debug("Got state", "state", state)
 
 	if err != nil {
-		poll_interval = time.Duration(1) * time.Second
-
-		// Happens when vehicle was in range for connection_status, but not for body_controller_state and vehicle_data
-		if strings.Contains(err.Error(), "vehicle not in range") {
-			state = make(map[string]string)
-			state["status"] = "offline"
-			err = nil
+		// Happens when vehicle was in range for connection_status, but not for body_controller_state and vehicle_data,
+		// or when the proxy keeps failing and is not polled for a while
+		if errors.Is(err, proxyclient.ErrNotInRange) || errors.Is(err, proxyclient.ErrCircuitOpen) {
+			p.endpoints.clear()
+			polled_state = map[string]any{"status": "offline"}
+			state = bindState(disc.StateBindings, polled_state)
 		} else {
 			if ctx.Err() != nil {
-				return poll_interval, ctx.Err()
+				return time.Duration(1) * time.Second, ctx.Err()
 			}
-			log.Warn("Failed to get state", "handler", disc.ClientId, "error", err)
-			return poll_interval, err
+			log.Warn("Failed to get state", "handler", disc.Id, "error", err)
+			return time.Duration(1) * time.Second, err
 		}
 	}
 
-	if state["status"] == "online" {
-		p.online_hysteresis = 3
-	} else {
-		p.online_hysteresis = max(p.online_hysteresis-1, 0)
-		// Keep online
-		if p.online_hysteresis > 0 {
-			log.Debug("Device going offline", "handler", disc.ClientId, "hysteresis", p.online_hysteresis)
-			skip_publish = true
-			poll_interval = time.Duration(1) * time.Second // Retry quickly when going offline
-		} else {
-			poll_interval = time.Duration(s.PollIntervalDisconnected) * time.Second
-		}
+	poll := PollState{
+		Handler: disc.Id,
+		Start:   start,
+		Online:  state["status"] == "online",
+		State:   polled_state,
+	}
+	if !p.policy.Publish(&poll) {
+		return p.policy.Interval(&poll, false), nil
 	}
 
-	if err == nil && !skip_publish {
-		for topic, access_path := range disc.PublishBindings {
-			// If new state is different from old state, publish
-			if new_state, ok := state[topic]; ok {
-				if new_state != old_state[topic] {
-					start_fast_poll = start_fast_poll || isFastPollEvent(access_path, new_state)
-
-					if disc.ClientId != s.MqttPrefix {
-						log.Info("Publishing", "topic", topic, "access path", access_path, "state", new_state, "old_state", old_state[topic])
-					}
-					token := mqtt_client.Publish(topic, s.MqttQos, true, new_state)
-					select {
-					case <-ctx.Done():
-						return time.Duration(1) * time.Second, ctx.Err()
-					case <-token.Done():
-					}
-					if token.Error() != nil {
-						log.Error("Failed to publish to topic", "error", token.Error())
-						return time.Duration(1) * time.Second, token.Error()
-					}
-					old_state[topic] = new_state
-				}
-			}
-		}
-		if pi, ok := state["poll_interval"]; ok {
-			pi_int, err := strconv.Atoi(pi)
-			if err == nil {
-				poll_interval = time.Duration(pi_int) * time.Second
-			} else {
-				log.Error("Failed to parse poll_interval", "error", err)
+	for topic, state_binding := range disc.StateBindings {
+		// If new state is different from old state, publish
+		if raw_state, ok := state[topic]; ok {
+			binding := disc.PublishBindings[topic]
+			new_state, err := state_binding.Apply(raw_state)
+			if err != nil {
+				log.Warn("Failed to transform state", "topic", topic, "binding", binding, "error", err)
+				continue
 			}
-		}
+			if new_state != old_state[topic] {
+				start_fast_poll = start_fast_poll || isFastPollEvent(state_binding.Path, raw_state)
 
-		// Process fast polling
-		if disc.ClientId != s.MqttPrefix && s.FastPollTime > 0 {
-			if start_fast_poll {
-				if p.fast_poll_start_time.IsZero() {
-					log.Debug("Starting fast poll", "handler", disc.ClientId)
-				} else {
-					log.Debug("Extending fast poll", "handler", disc.ClientId)
+				if disc.Id != s.MqttPrefix {
+					log.Info("Publishing", "topic", topic, "access path", binding, "state", new_state, "old_state", old_state[topic])
 				}
-
-				p.fast_poll_interval = 0
-				p.fast_poll_start_time = time.Now()
-				return 0, nil
-			} else if !p.fast_poll_start_time.IsZero() {
-				if time.Since(p.fast_poll_start_time) > time.Duration(s.FastPollTime)*time.Second {
-					log.Debug("Stopping fast poll", "handler", disc.ClientId)
-					p.fast_poll_interval = 0
-					p.fast_poll_start_time = time.Time{}
-				} else {
-					if time.Since(p.fast_poll_start_time) < time.Duration(s.FastPollTime/2)*time.Second {
-						// First half of fast poll time, we will poll every second
-						return time.Duration(1) * time.Second, nil
-					} else {
-						// Second half of fast poll time, we will slowly increase the poll interval
-						w := 0.97
-						a := w * float64(p.fast_poll_interval)
-						b := (1 - w) * float64(poll_interval)
-						p.fast_poll_interval = time.Duration(a + b)
-
-						return p.fast_poll_interval, nil
+				props := &broker.Properties{
+					MessageExpiry: time.Duration(s.MqttMessageExpiry) * time.Second,
+					User:          map[string]string{"vin": vin, "access_path": state_binding.Path},
+				}
+				if strings.HasPrefix(new_state, "{") || strings.HasPrefix(new_state, "[") {
+					props.ContentType = "application/json"
+				}
+				if err := conn.PublishQueued(ctx, topic, true, new_state, props); err != nil {
+					if ctx.Err() != nil {
+						return time.Duration(1) * time.Second, ctx.Err()
 					}
+					log.Error("Failed to publish to topic", "error", err)
+					return time.Duration(1) * time.Second, err
 				}
+				old_state[topic] = new_state
 			}
 		}
-	} else if err != nil {
-		log.Debug("Failed to get state", "error", err)
-		return poll_interval, err
 	}
 
-	return poll_interval - time.Since(start), nil
+	// The handler device does not fast poll
+	return p.policy.Interval(&poll, start_fast_poll && disc.Id != s.MqttPrefix), nil
+}
+
+// subscribeTopics returns the command topics of a handler along with the HA status topic
+func subscribeTopics(disc *discovery.DiscoveryHandler, ha_status_topic string) []string {
+	to_subscribe := []string{}
+	for topic := range disc.SubscribeBindings {
+		to_subscribe = append(to_subscribe, topic)
+	}
+	// Subscribe to status topic to resend discovery on HA restart
+	return append(to_subscribe, ha_status_topic)
 }
 
 // Run is the main handler function, it takes a discovery object and runs the handler
 // for the given device. It will handle the discovery and mqtt communication for the
-// given device along with fetching and updating the device state defined in the discovery bindings.
+// given device over the shared connection along with fetching and updating the device
+// state defined in the discovery bindings. Discoveries received on updates (with the
+// same Id) replace the bindings of the running handler.
 // This function should be run as a goroutine.
-func Run(ctx context.Context, wg *sync.WaitGroup, disc *discovery.DiscoveryHandler) {
-	log.Debug("Running", "handler", disc.Discovery.DeviceType, "for", disc.ClientId)
+func Run(ctx context.Context, wg *sync.WaitGroup, conn *broker.Connection, disc *discovery.DiscoveryHandler, updates <-chan discovery.DiscoveryHandler) {
+	log.Debug("Running", "handler", disc.Discovery.DeviceType, "for", disc.Id)
 	defer wg.Done()
 
 	s := settings.Get()
 
-	clear_old_state_request := false
-	clientOpts := mqtt.NewClientOptions().
-		AddBroker(fmt.Sprintf("tcp://%s:%d", s.MqttHost, s.MqttPort)).
-		SetUsername(s.MqttUser).
-		SetPassword(s.MqttPass).
-		SetClientID(disc.ClientId).
-		SetWill(disc.WillTopic, "offline", s.MqttQos, true).
-		SetOnConnectHandler(func(client mqtt.Client) {
-			log.Info("Connected to MQTT", "client_id", disc.ClientId)
-			clear_old_state_request = true
-			if err := publishDiscovery(client, &disc.Discovery); err != nil {
-				log.Error("Failed to publish discovery", "error", err)
-				return
-			}
-		}).
-		SetConnectionLostHandler(func(client mqtt.Client, err error) {
-			log.Error("Connection lost to MQTT", "client_id", disc.ClientId, "error", err)
-		})
+	// Bindings can be swapped while running, Vin, Id and StatusTopic stay the same
+	current := atomic.Pointer[discovery.DiscoveryHandler]{}
+	current.Store(disc)
 
-	mqtt_client := mqtt.NewClient(clientOpts)
+	ha_status_topic := fmt.Sprintf("%s/status", s.DiscoveryPrefix)
 
-	if token := mqtt_client.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatal("Failed to connect to MQTT", "error", token.Error())
-		return
+	clear_old_state_request := false
+	sub, err := conn.Subscribe(subscribeTopics(disc, ha_status_topic), func() {
+		clear_old_state_request = true
+		if err := publishDiscovery(ctx, conn, &current.Load().Discovery); err != nil {
+			log.Error("Failed to publish discovery", "error", err)
+			return
+		}
+	})
+	if err != nil {
+		log.Error("Failed to subscribe", "handler", disc.Id, "error", err)
 	}
-
-	defer mqtt_client.Disconnect(250)
+	defer conn.Unsubscribe(sub)
 	defer func() {
-		token := mqtt_client.Publish(disc.WillTopic, s.MqttQos, true, "offline")
-		token.Wait()
+		if err := conn.Publish(context.Background(), disc.StatusTopic, true, "offline"); err != nil {
+			log.Error("Failed to publish offline status", "handler", disc.Id, "error", err)
+		}
 	}()
 
-	to_subscribe := map[string]byte{}
-	for topic := range disc.SubscribeBindings {
-		to_subscribe[topic] = s.MqttQos
-	}
-	// Subscribe to status topic to resend discovery on HA restart
-	ha_status_topic := fmt.Sprintf("%s/status", s.DiscoveryPrefix)
-	to_subscribe[ha_status_topic] = s.MqttQos
-
-	message_chan := make(chan mqtt.Message, 10)
-
-	mqtt_client.SubscribeMultiple(to_subscribe, func(client mqtt.Client, msg mqtt.Message) {
-		message_chan <- msg
-	})
-
 	cancel_get_state_ch := make(chan bool)
 
-	http_client := &http.Client{}
+	proxy := newProxyRouter(current.Load().Vin)
 
 	// Publish loop
 	go func() {
 		old_state := make(map[ha_discovery.Topic]string)
-		persistent := publishStatePersistent{}
+		persistent := publishStatePersistent{
+			policy:    newPollPolicy(current.Load().Vin),
+			raw:       newRawPublisher(conn, current.Load().Vin),
+			endpoints: newEndpointScheduler(),
+		}
 		start_fast_poll := false
 	start_publish:
 		for {
+			disc := current.Load()
 			publishCtx, cancel := context.WithCancel(ctx)
 			defer cancel()
-			done := make(chan bool)
+			// Buffered, a publish that was cancelled or timed out can finish after the loop moved on
+			published := make(chan bool, 1)
+			done := make(chan bool, 1)
 			go func() {
 				if clear_old_state_request {
-					log.Debug("Clearing old state", "handler", disc.ClientId)
+					log.Debug("Clearing old state", "handler", disc.Id)
 					old_state = make(map[ha_discovery.Topic]string)
 					clear_old_state_request = false
 				}
-				to_wait, err := publishState(publishCtx, disc.Vin, http_client, mqtt_client, disc, old_state, &persistent, start_fast_poll)
+				to_wait, err := publishState(publishCtx, disc.Vin, proxy, conn, disc, old_state, &persistent, start_fast_poll)
 				start_fast_poll = false
 				if err != nil && err != publishCtx.Err() {
 					log.Error("Failed to publish state", "error", err)
-					publishError(mqtt_client, disc.Vin, err)
+					publishError(ctx, conn, disc.Vin, err)
 				}
+				published <- true
 				select {
 				case <-time.After(to_wait):
 				case <-publishCtx.Done():
 				}
 				done <- true
 			}()
+			// Just in case publishState gets stuck, it is cancelled and restarted once every proxy request
+			// had time to time out. The wait for the next poll is not limited, poll policy rules can set
+			// longer intervals.
+			watchdog := time.After(pollTimeout(disc.Vin))
 			for {
 				select {
+				case <-published:
+					watchdog = nil
 				case <-done:
 					continue start_publish
 				case <-publishCtx.Done():
@@ -489,22 +482,21 @@ func Run(ctx context.Context, wg *sync.WaitGroup, disc *discovery.DiscoveryHandl
 					continue start_publish
 				case end := <-cancel_get_state_ch:
 					if end {
-						log.Debug("Canceling publish", "handler", disc.ClientId)
+						log.Debug("Canceling publish", "handler", disc.Id)
 						cancel()
 						select {
 						case <-ctx.Done():
 							return
 						case <-cancel_get_state_ch:
-							log.Debug("Resuming publish", "handler", disc.ClientId)
+							log.Debug("Resuming publish", "handler", disc.Id)
 							start_fast_poll = true // Start fast poll since a command interrupted the publish
 							continue start_publish
 						}
 					} else {
-						log.Warn("Got signal to get state, but is already doing so", "handler", disc.ClientId)
+						log.Warn("Got signal to get state, but is already doing so", "handler", disc.Id)
 					}
-				// Just in case the publish loop gets stuck, we will timeout after 20+interval seconds and restart
-				case <-time.After(time.Duration(20+s.PollInterval) * time.Second):
-					log.Warn("Publish loop timed out", "handler", disc.ClientId)
+				case <-watchdog:
+					log.Warn("Publish loop timed out", "handler", disc.Id)
 					cancel()
 					continue start_publish
 				}
@@ -517,35 +509,62 @@ handler_loop:
 	for {
 		select {
 		case <-ctx.Done():
-			log.Debug("Context done, shutting down", "handler", disc.ClientId)
+			log.Debug("Context done, shutting down", "handler", disc.Id)
 			break handler_loop
-		case msg := <-message_chan:
-			log.Debug("Received message", "topic", msg.Topic(), "message", string(msg.Payload()))
+		case msg := <-sub.Messages:
+			log.Debug("Received message", "topic", msg.Topic, "message", string(msg.Payload))
 
-			if msg.Topic() == ha_status_topic {
-				log.Debug("HA status changed", "to", string(msg.Payload()))
-				if string(msg.Payload()) != "online" {
+			if msg.Topic == ha_status_topic {
+				log.Debug("HA status changed", "to", string(msg.Payload))
+				if string(msg.Payload) != "online" {
 					continue
 				}
 				log.Info("Resending discovery", "topic", ha_status_topic)
-				if err := publishDiscovery(mqtt_client, &disc.Discovery); err != nil {
+				if err := publishDiscovery(ctx, conn, &current.Load().Discovery); err != nil {
 					log.Error("Failed to publish discovery", "error", err)
 				}
 				clear_old_state_request = true
 				continue
 			}
 
-			if handler, ok := disc.SubscribeBindings[msg.Topic()]; ok {
+			if handler, ok := current.Load().SubscribeBindings[msg.Topic]; ok {
 				cancel_get_state_ch <- true
-				err := handleCommand(ctx, disc.Vin, http_client, mqtt_client, handler, msg.Payload())
+				command_start := time.Now()
+				action, err := handleCommand(ctx, disc.Vin, proxy.client(), conn, handler, msg.Payload)
 				cancel_get_state_ch <- false
 				if err != nil {
 					log.Error("Failed to handle command", "error", err)
-					publishError(mqtt_client, disc.Vin, err)
+					publishError(ctx, conn, disc.Vin, err)
+				}
+				if msg.ResponseTopic != "" {
+					publishCommandResponse(ctx, conn, &msg, action, time.Since(command_start), err)
 				}
 			} else {
-				log.Warn("No handler for message", "topic", msg.Topic())
+				log.Warn("No handler for message", "topic", msg.Topic)
+			}
+		case update := <-updates:
+			old := current.Load()
+			discovery_changed := !bytes.Equal(old.Discovery.Message, update.Discovery.Message)
+			subscribe_changed := !reflect.DeepEqual(old.SubscribeBindings, update.SubscribeBindings)
+			if !discovery_changed && !subscribe_changed && maps.Equal(old.PublishBindings, update.PublishBindings) {
+				log.Debug("Discovery unchanged", "handler", disc.Id)
+				continue
 			}
+			log.Info("Reloading discovery", "handler", disc.Id)
+
+			if subscribe_changed {
+				if err := conn.Resubscribe(sub, subscribeTopics(&update, ha_status_topic)); err != nil {
+					log.Error("Failed to resubscribe", "handler", disc.Id, "error", err)
+				}
+			}
+			current.Store(&update)
+			if discovery_changed {
+				if err := publishDiscoveryUpdate(ctx, conn, &old.Discovery, &update.Discovery); err != nil {
+					log.Error("Failed to publish discovery", "error", err)
+				}
+			}
+			// Republish every state, bindings might point to new topics
+			clear_old_state_request = true
 		}
 	}
 }
@@ -0,0 +1,274 @@
+package handler
+
+import (
+	"TeslaBle2Mqtt/internal/settings"
+	"TeslaBle2Mqtt/pkg/ha_discovery"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"gopkg.in/yaml.v3"
+)
+
+// PollState is the result of a poll, as seen by a poll policy
+type PollState struct {
+	Handler string
+	// Start of the poll, the returned interval counts from it
+	Start  time.Time
+	Online bool
+	// State the access paths are resolved against (status, connection_status, vehicle_data, ...)
+	State map[string]any
+}
+
+// PollPolicy decides when a handler polls the proxy again
+type PollPolicy interface {
+	// Publish reports if the polled state should be published
+	Publish(state *PollState) bool
+	// Interval returns the time until the next poll, fast_poll is set after a command or an event
+	// that is likely to be followed by more changes
+	Interval(state *PollState, fast_poll bool) time.Duration
+}
+
+// Number of polls the vehicle has to be unreachable before it is published as offline
+const onlineHysteresis = 3
+
+// Weight of the previous interval in the second half of fast polling, when the interval slowly
+// returns to the normal one
+const fastPollRampWeight = 0.97
+
+// defaultPollPolicy polls at --poll-interval, --poll-interval-charging while charging and
+// --poll-interval-disconnected while offline, and every second for a while after a command
+type defaultPollPolicy struct {
+	vin                  string
+	online_hysteresis    int
+	fast_poll_start_time time.Time
+	fast_poll_interval   time.Duration
+}
+
+func (p *defaultPollPolicy) Publish(state *PollState) bool {
+	if state.Online {
+		p.online_hysteresis = onlineHysteresis
+		return true
+	}
+	p.online_hysteresis = max(p.online_hysteresis-1, 0)
+	// Keep online
+	if p.online_hysteresis > 0 {
+		log.Debug("Device going offline", "handler", state.Handler, "hysteresis", p.online_hysteresis)
+		return false
+	}
+	return true
+}
+
+func (p *defaultPollPolicy) Interval(state *PollState, fast_poll bool) time.Duration {
+	v := settings.Get().ForVin(p.vin)
+	poll_interval := time.Duration(v.PollInterval) * time.Second
+	if !state.Online {
+		poll_interval = time.Duration(v.PollIntervalDisconnected) * time.Second
+	} else if charging_state, _ := lookupPollState(state, "vehicle_data.charge_state.charging_state"); charging_state == "Charging" {
+		poll_interval = time.Duration(v.PollIntervalCharging) * time.Second
+		log.Debug("Using charging poll interval", "vin", p.vin)
+	}
+	return p.interval(state, fast_poll, poll_interval)
+}
+
+// interval applies the offline retry and fast polling to the interval chosen by the policy
+func (p *defaultPollPolicy) interval(state *PollState, fast_poll bool, poll_interval time.Duration) time.Duration {
+	if !state.Online && p.online_hysteresis > 0 {
+		return time.Duration(1)*time.Second - time.Since(state.Start) // Retry quickly when going offline
+	}
+
+	v := settings.Get().ForVin(p.vin)
+	if v.FastPollTime > 0 {
+		if fast_poll {
+			if p.fast_poll_start_time.IsZero() {
+				log.Debug("Starting fast poll", "handler", state.Handler)
+			} else {
+				log.Debug("Extending fast poll", "handler", state.Handler)
+			}
+
+			p.fast_poll_interval = 0
+			p.fast_poll_start_time = time.Now()
+			return 0
+		} else if !p.fast_poll_start_time.IsZero() {
+			if time.Since(p.fast_poll_start_time) > time.Duration(v.FastPollTime)*time.Second {
+				log.Debug("Stopping fast poll", "handler", state.Handler)
+				p.fast_poll_interval = 0
+				p.fast_poll_start_time = time.Time{}
+			} else {
+				if time.Since(p.fast_poll_start_time) < time.Duration(v.FastPollTime/2)*time.Second {
+					// First half of fast poll time, we will poll every second
+					return time.Duration(1) * time.Second
+				} else {
+					// Second half of fast poll time, we will slowly increase the poll interval
+					a := fastPollRampWeight * float64(p.fast_poll_interval)
+					b := (1 - fastPollRampWeight) * float64(poll_interval)
+					p.fast_poll_interval = time.Duration(a + b)
+
+					return p.fast_poll_interval
+				}
+			}
+		}
+	}
+
+	return poll_interval - time.Since(state.Start)
+}
+
+// pollCondition compares the value at an access path, e.g. `Charging`, `!=Charging` or `>90`
+type pollCondition struct {
+	path     ha_discovery.Path
+	operator string
+	value    string
+}
+
+// pollRule sets the poll interval while all of its conditions match
+type pollRule struct {
+	Name       string            `yaml:"name"`
+	When       map[string]string `yaml:"when"`
+	Interval   int               `yaml:"interval"`
+	conditions []pollCondition
+}
+
+// Longer operators first, so `>=` is not parsed as `>`
+var pollOperators = []string{"!=", ">=", "<=", ">", "<", "="}
+
+func parsePollCondition(path string, condition string) (pollCondition, error) {
+	c := pollCondition{operator: "=", value: condition}
+	var err error
+	if c.path, err = ha_discovery.ParsePath(path); err != nil {
+		return c, err
+	}
+	for _, operator := range pollOperators {
+		if value, ok := strings.CutPrefix(condition, operator); ok {
+			c.operator = operator
+			c.value = strings.TrimSpace(value)
+			break
+		}
+	}
+	if c.operator != "=" && c.operator != "!=" {
+		if _, err := strconv.ParseFloat(c.value, 64); err != nil {
+			return c, fmt.Errorf("`%s` expects a number, got `%s`", c.operator, c.value)
+		}
+	}
+	return c, nil
+}
+
+func (c *pollCondition) matches(state *PollState) bool {
+	value, ok := c.path.Evaluate(state.State)
+	if !ok {
+		return false
+	}
+	value_str := formatStateValue(value)
+	switch c.operator {
+	case "=":
+		return value_str == c.value
+	case "!=":
+		return value_str != c.value
+	}
+	value_f, err := strconv.ParseFloat(value_str, 64)
+	if err != nil {
+		return false
+	}
+	compare_f, _ := strconv.ParseFloat(c.value, 64)
+	switch c.operator {
+	case ">":
+		return value_f > compare_f
+	case ">=":
+		return value_f >= compare_f
+	case "<":
+		return value_f < compare_f
+	case "<=":
+		return value_f <= compare_f
+	}
+	return false
+}
+
+func (r *pollRule) matches(state *PollState) bool {
+	for i := range r.conditions {
+		if !r.conditions[i].matches(state) {
+			return false
+		}
+	}
+	return true
+}
+
+// rulePollPolicy is the default policy with the poll interval set by the first matching rule
+type rulePollPolicy struct {
+	defaultPollPolicy
+	rules []pollRule
+}
+
+func (p *rulePollPolicy) Interval(state *PollState, fast_poll bool) time.Duration {
+	for i := range p.rules {
+		if p.rules[i].matches(state) {
+			log.Debug("Using poll rule", "handler", state.Handler, "rule", p.rules[i].Name)
+			return p.interval(state, fast_poll, time.Duration(p.rules[i].Interval)*time.Second)
+		}
+	}
+	return p.defaultPollPolicy.Interval(state, fast_poll)
+}
+
+// Rules loaded from --poll-policy, nil to use the default policy
+var poll_rules []pollRule
+
+// LoadPollPolicy reads the poll rules from a YAML file, in the form
+//
+//	rules:
+//	  - name: Charging almost full
+//	    when:
+//	      vehicle_data.charge_state.charging_state: Charging
+//	      vehicle_data.charge_state.battery_level: ">90"
+//	    interval: 10
+func LoadPollPolicy(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var policy struct {
+		Rules []pollRule `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal(data, &policy); err != nil {
+		return err
+	}
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if rule.Interval <= 0 {
+			return fmt.Errorf("rule %s: interval must be positive", rule.Name)
+		}
+		for path, condition := range rule.When {
+			c, err := parsePollCondition(path, condition)
+			if err != nil {
+				return fmt.Errorf("rule %s: %w", rule.Name, err)
+			}
+			rule.conditions = append(rule.conditions, c)
+		}
+	}
+	poll_rules = policy.Rules
+	return nil
+}
+
+// newPollPolicy returns the poll policy for a handler
+func newPollPolicy(vin string) PollPolicy {
+	if poll_rules != nil {
+		return &rulePollPolicy{defaultPollPolicy: defaultPollPolicy{vin: vin}, rules: poll_rules}
+	}
+	return &defaultPollPolicy{vin: vin}
+}
+
+// lookupPollState returns the formatted value at an access path of the polled state
+func lookupPollState(state *PollState, access_path string) (string, bool) {
+	path, err := ha_discovery.ParsePath(access_path)
+	if err != nil {
+		return "", false
+	}
+	value, ok := path.Evaluate(state.State)
+	if !ok {
+		return "", false
+	}
+	return formatStateValue(value), true
+}
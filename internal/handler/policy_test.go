@@ -0,0 +1,313 @@
+package handler
+
+import (
+	"TeslaBle2Mqtt/internal/settings"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testVin = "5YJ3E1EA1KF000001"
+
+func setTestSettings(fast_poll_time int) {
+	settings.Set(&settings.Settings{
+		PollInterval:             90,
+		PollIntervalCharging:     20,
+		PollIntervalDisconnected: 60,
+		FastPollTime:             fast_poll_time,
+	})
+}
+
+// pollState returns a state polled just now, charging_state is left out if empty
+func pollState(online bool, charging_state string) *PollState {
+	state := &PollState{Handler: "test", Start: time.Now(), Online: online, State: map[string]any{}}
+	if charging_state != "" {
+		state.State["vehicle_data"] = map[string]any{"charge_state": map[string]any{"charging_state": charging_state}}
+	}
+	return state
+}
+
+// expectInterval checks an interval counted from the start of a poll, which is a little shorter
+// than the one chosen by the policy
+func expectInterval(t *testing.T, got time.Duration, want time.Duration) {
+	t.Helper()
+	if got > want || got < want-100*time.Millisecond {
+		t.Errorf("got %v, expected %v", got, want)
+	}
+}
+
+func TestDefaultPollPolicyPublish(t *testing.T) {
+	p := &defaultPollPolicy{vin: testVin}
+	// Offline at start is published right away, going offline only after 3 polls
+	polls := []struct {
+		online  bool
+		publish bool
+	}{
+		{false, true},
+		{true, true},
+		{false, false},
+		{false, false},
+		{false, true},
+		{false, true},
+		{true, true},
+		{false, false},
+		{true, true},
+	}
+	for i, poll := range polls {
+		if publish := p.Publish(pollState(poll.online, "")); publish != poll.publish {
+			t.Errorf("poll %d: got %v, expected %v", i, publish, poll.publish)
+		}
+	}
+}
+
+func TestDefaultPollPolicyInterval(t *testing.T) {
+	setTestSettings(0)
+	tests := []struct {
+		name           string
+		online         bool
+		going_offline  bool
+		charging_state string
+		want           time.Duration
+	}{
+		{name: "online", online: true, want: 90 * time.Second},
+		{name: "charging", online: true, charging_state: "Charging", want: 20 * time.Second},
+		{name: "not charging", online: true, charging_state: "Stopped", want: 90 * time.Second},
+		{name: "going offline", going_offline: true, want: time.Second},
+		{name: "offline", want: 60 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &defaultPollPolicy{vin: testVin}
+			if test.going_offline {
+				p.Publish(pollState(true, ""))
+			}
+			state := pollState(test.online, test.charging_state)
+			p.Publish(state)
+			expectInterval(t, p.Interval(state, false), test.want)
+		})
+	}
+
+	// Vehicle settings replace the global ones
+	s := settings.Get()
+	s.Vehicles = map[string]settings.VehicleSettings{testVin: {PollInterval: 30, PollIntervalCharging: 5}}
+	p := &defaultPollPolicy{vin: testVin}
+	expectInterval(t, p.Interval(pollState(true, ""), false), 30*time.Second)
+	expectInterval(t, p.Interval(pollState(true, "Charging"), false), 5*time.Second)
+	expectInterval(t, (&defaultPollPolicy{vin: "5YJ3E1EA1KF000002"}).Interval(pollState(true, ""), false), 90*time.Second)
+}
+
+func TestDefaultPollPolicyFastPoll(t *testing.T) {
+	setTestSettings(120)
+	p := &defaultPollPolicy{vin: testVin}
+
+	if interval := p.Interval(pollState(true, ""), true); interval != 0 {
+		t.Fatalf("got %v after a command, expected an immediate poll", interval)
+	}
+	// First half of the fast poll time
+	if interval := p.Interval(pollState(true, ""), false); interval != time.Second {
+		t.Fatalf("got %v in the first half, expected 1s", interval)
+	}
+
+	// Second half, the interval slowly goes back to the poll interval
+	p.fast_poll_start_time = time.Now().Add(-61 * time.Second)
+	for _, want := range []time.Duration{2700 * time.Millisecond, 5319 * time.Millisecond, 7859430 * time.Microsecond} {
+		if interval := p.Interval(pollState(true, ""), false); interval < want-time.Millisecond || interval > want+time.Millisecond {
+			t.Fatalf("got %v in the second half, expected %v", interval, want)
+		}
+	}
+	// towards the charging interval while charging
+	want := time.Duration(0.97*float64(p.fast_poll_interval) + 0.03*float64(20*time.Second))
+	if interval := p.Interval(pollState(true, "Charging"), false); interval < want-time.Millisecond || interval > want+time.Millisecond {
+		t.Fatalf("got %v while charging, expected %v", interval, want)
+	}
+
+	// Another command starts over
+	if interval := p.Interval(pollState(true, ""), true); interval != 0 || p.fast_poll_interval != 0 {
+		t.Fatalf("got %v after another command, expected an immediate poll", interval)
+	}
+
+	// Going offline retries quickly even while fast polling
+	p.Publish(pollState(true, ""))
+	state := pollState(false, "")
+	p.Publish(state)
+	expectInterval(t, p.Interval(state, false), time.Second)
+
+	// Back to the poll interval after the fast poll time
+	p.fast_poll_start_time = time.Now().Add(-121 * time.Second)
+	expectInterval(t, p.Interval(pollState(true, ""), false), 90*time.Second)
+	if !p.fast_poll_start_time.IsZero() {
+		t.Error("fast poll did not stop")
+	}
+
+	// No fast polling with a fast poll time of 0
+	setTestSettings(0)
+	expectInterval(t, p.Interval(pollState(true, ""), true), 90*time.Second)
+}
+
+func TestParsePollCondition(t *testing.T) {
+	tests := []struct {
+		condition string
+		operator  string
+		value     string
+		err       string
+	}{
+		{condition: "Charging", operator: "=", value: "Charging"},
+		{condition: "=Charging", operator: "=", value: "Charging"},
+		{condition: "!=Charging", operator: "!=", value: "Charging"},
+		{condition: ">90", operator: ">", value: "90"},
+		{condition: ">= 90", operator: ">=", value: "90"},
+		{condition: "<=5.5", operator: "<=", value: "5.5"},
+		{condition: "<-10", operator: "<", value: "-10"},
+		{condition: ">full", err: "`>` expects a number, got `full`"},
+		{condition: "<=", err: "`<=` expects a number, got ``"},
+	}
+	for _, test := range tests {
+		t.Run(test.condition, func(t *testing.T) {
+			c, err := parsePollCondition("vehicle_data.charge_state.battery_level", test.condition)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.operator != test.operator || c.value != test.value {
+				t.Errorf("got %s %s, expected %s %s", c.operator, c.value, test.operator, test.value)
+			}
+		})
+	}
+
+	if _, err := parsePollCondition("", "Charging"); err == nil {
+		t.Error("expected an error for an empty path")
+	}
+}
+
+func TestPollConditionMatches(t *testing.T) {
+	state := &PollState{State: map[string]any{
+		"vehicle_data": map[string]any{
+			"charge_state": map[string]any{"charging_state": "Charging", "battery_level": float64(90)},
+		},
+	}}
+	tests := []struct {
+		path      string
+		condition string
+		matches   bool
+	}{
+		{"vehicle_data.charge_state.charging_state", "Charging", true},
+		{"vehicle_data.charge_state.charging_state", "Stopped", false},
+		{"vehicle_data.charge_state.charging_state", "!=Stopped", true},
+		{"vehicle_data.charge_state.charging_state", "!=Charging", false},
+		{"vehicle_data.charge_state.battery_level", "90", true},
+		{"vehicle_data.charge_state.battery_level", ">89.5", true},
+		{"vehicle_data.charge_state.battery_level", ">90", false},
+		{"vehicle_data.charge_state.battery_level", ">=90", true},
+		{"vehicle_data.charge_state.battery_level", "<90", false},
+		{"vehicle_data.charge_state.battery_level", "<=90", true},
+		{"vehicle_data.charge_state.battery_level", "<100", true},
+		// Not a number
+		{"vehicle_data.charge_state.charging_state", ">0", false},
+		// Missing values never match, not even with !=
+		{"vehicle_data.charge_state.missing", "!=Charging", false},
+		{"vehicle_data.climate_state.inside_temp", "<10", false},
+	}
+	for _, test := range tests {
+		t.Run(test.path+" "+test.condition, func(t *testing.T) {
+			c, err := parsePollCondition(test.path, test.condition)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if matches := c.matches(state); matches != test.matches {
+				t.Errorf("got %v, expected %v", matches, test.matches)
+			}
+		})
+	}
+}
+
+func writePollPolicy(t *testing.T, content string) string {
+	filename := filepath.Join(t.TempDir(), "poll_policy.yaml")
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { poll_rules = nil })
+	return filename
+}
+
+func TestRulePollPolicy(t *testing.T) {
+	setTestSettings(0)
+	filename := writePollPolicy(t, `
+rules:
+  - name: Charging almost full
+    when:
+      vehicle_data.charge_state.charging_state: Charging
+      vehicle_data.charge_state.battery_level: ">90"
+    interval: 10
+  - when:
+      vehicle_data.charge_state.charging_state: Charging
+    interval: 30
+`)
+	if err := LoadPollPolicy(filename); err != nil {
+		t.Fatal(err)
+	}
+	if poll_rules[1].Name != "#2" {
+		t.Errorf("got %q for a rule without a name", poll_rules[1].Name)
+	}
+	p := newPollPolicy(testVin)
+	if _, ok := p.(*rulePollPolicy); !ok {
+		t.Fatalf("got %T with poll rules", p)
+	}
+
+	charging := func(battery_level float64) *PollState {
+		state := pollState(true, "Charging")
+		state.State["vehicle_data"].(map[string]any)["charge_state"].(map[string]any)["battery_level"] = battery_level
+		return state
+	}
+	// First matching rule
+	expectInterval(t, p.Interval(charging(95), false), 10*time.Second)
+	expectInterval(t, p.Interval(charging(50), false), 30*time.Second)
+	// No matching rule, default policy
+	expectInterval(t, p.Interval(pollState(true, ""), false), 90*time.Second)
+	expectInterval(t, p.Interval(pollState(false, ""), false), 60*time.Second)
+	// Fast polling still applies to rules
+	setTestSettings(120)
+	if interval := p.Interval(charging(95), true); interval != 0 {
+		t.Errorf("got %v after a command, expected an immediate poll", interval)
+	}
+
+	poll_rules = nil
+	if _, ok := newPollPolicy(testVin).(*defaultPollPolicy); !ok {
+		t.Error("expected the default policy without poll rules")
+	}
+}
+
+func TestLoadPollPolicyErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		err    string
+	}{
+		{name: "no interval", policy: "rules:\n  - name: Slow\n    when: {status: online}\n", err: "rule Slow: interval must be positive"},
+		{name: "negative interval", policy: "rules:\n  - when: {status: online}\n    interval: -1\n", err: "rule #1: interval must be positive"},
+		{name: "invalid condition", policy: "rules:\n  - when: {vehicle_data.charge_state.battery_level: \">high\"}\n    interval: 10\n", err: "rule #1: `>` expects a number"},
+		{name: "invalid path", policy: "rules:\n  - when: {\"unknown(x).a\": \"1\"}\n    interval: 10\n", err: "rule #1: unknown function `unknown`"},
+		{name: "invalid yaml", policy: "rules: [\n", err: "yaml"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := LoadPollPolicy(writePollPolicy(t, test.policy))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error %q, got %v", test.err, err)
+			}
+			if poll_rules != nil {
+				t.Error("rules were set from an invalid policy")
+			}
+		})
+	}
+
+	if err := LoadPollPolicy(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"TeslaBle2Mqtt/internal/settings"
+	"TeslaBle2Mqtt/pkg/proxyclient"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+var proxy_clients = make(map[string]*proxyclient.Client)
+var proxy_clients_lock sync.Mutex
+
+// Shared by every proxy client, set by InitProxy
+var proxy_http_client = &http.Client{}
+
+// InitProxy sets up the HTTP client of the proxy clients with the --proxy-tls-ca certificates,
+// main calls it next to broker.Init
+func InitProxy() error {
+	s := settings.Get()
+	if s.ProxyCaFile == "" {
+		return nil
+	}
+	pool, err := settings.LoadCaFile(s.ProxyCaFile, "proxy")
+	if err != nil {
+		return err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	proxy_http_client = &http.Client{Transport: transport}
+	return nil
+}
+
+// getProxyClient returns the client for a proxy host, it is shared by every vehicle using the same
+// proxy so they share its circuit breaker
+func getProxyClient(host string) *proxyclient.Client {
+	proxy_clients_lock.Lock()
+	defer proxy_clients_lock.Unlock()
+	if c, ok := proxy_clients[host]; ok {
+		return c
+	}
+	s := settings.Get()
+	c := proxyclient.New(host, proxyclient.Options{
+		Retries:          s.ProxyRetries,
+		RetryBackoff:     time.Duration(s.ProxyRetryBackoff) * time.Millisecond,
+		BreakerThreshold: s.ProxyBreakerThreshold,
+		BreakerCooldown:  time.Duration(s.ProxyBreakerCooldown) * time.Second,
+		StatusTimeout:    time.Duration(s.ProxyTimeout) * time.Second,
+		CommandTimeout:   time.Duration(s.ProxyCommandTimeout) * time.Second,
+		Headers:          settings.Headers(s.ProxyHeaders),
+		BearerToken:      s.ProxyToken,
+		Username:         s.ProxyUser,
+		Password:         s.ProxyPass,
+		HttpClient:       proxy_http_client,
+	})
+	proxy_clients[host] = c
+	return c
+}
+
+// proxyHosts returns the proxy hosts of all vehicles, the global ones first
+func proxyHosts() []string {
+	s := settings.Get()
+	hosts := slices.Clone(s.ProxyHosts)
+	for _, vin := range s.Vins {
+		for _, host := range s.ForVin(vin).ProxyHosts {
+			if !slices.Contains(hosts, host) {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	return hosts
+}
+
+// pollTimeout returns how long a poll may take before the publish loop restarts it. It is long
+// enough for every proxy request of a poll to use up its timeout and retries: connection_status
+// from each proxy (one after another with failover), body_controller_state and vehicle_data, or
+// the health check of each proxy for the handler device.
+func pollTimeout(vin string) time.Duration {
+	s := settings.Get()
+	if s.ProxyTimeout == 0 {
+		// Requests only end with the poll, restart it if it takes much longer than the interval
+		return time.Duration(20+s.ForVin(vin).PollInterval) * time.Second
+	}
+	request := time.Duration(s.ProxyTimeout*(s.ProxyRetries+1)) * time.Second
+	// The backoff doubles with each retry, with up to 50% jitter
+	request += time.Duration(s.ProxyRetryBackoff) * time.Millisecond * time.Duration(1<<s.ProxyRetries-1)
+	return time.Duration(len(proxyHosts())+2)*request + 20*time.Second
+}
+
+// checkProxy returns the health of a proxy, published by the handler device. Reachable is set if
+// the proxy answered at all, so older proxies without the version endpoint are still reachable.
+func checkProxy(ctx context.Context, c *proxyclient.Client) map[string]any {
+	status := c.Status()
+	health := map[string]any{
+		"circuit_breaker":      status.CircuitBreaker,
+		"consecutive_failures": status.ConsecutiveFailures,
+		"reachable":            true,
+		"latency":              nil,
+		"version":              nil,
+	}
+	start := time.Now()
+	version, err := c.Version(ctx)
+	var url_err *url.Error
+	if errors.As(err, &url_err) {
+		log.Debug("Proxy is not reachable", "host", c.Host(), "error", err)
+		health["reachable"] = false
+		return health
+	}
+	health["latency"] = time.Since(start).Milliseconds()
+	if err != nil {
+		log.Debug("Failed to get proxy version", "host", c.Host(), "error", err)
+	} else {
+		health["version"] = version
+	}
+	return health
+}
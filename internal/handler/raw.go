@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"TeslaBle2Mqtt/internal/broker"
+	"TeslaBle2Mqtt/internal/settings"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// rawPublisher publishes the proxy responses of a vehicle to `<prefix>/<vin>/raw/<endpoint>`, so
+// bindings can be written and debugged from an MQTT explorer
+type rawPublisher struct {
+	conn      *broker.Connection
+	vin       string
+	published map[string]time.Time
+}
+
+// newRawPublisher returns nil if raw topics are disabled
+func newRawPublisher(conn *broker.Connection, vin string) *rawPublisher {
+	if !settings.Get().RawTopics {
+		return nil
+	}
+	return &rawPublisher{
+		conn:      conn,
+		vin:       vin,
+		published: make(map[string]time.Time),
+	}
+}
+
+// publish publishes a response, unless the same endpoint was published less than --raw-topics-interval ago
+func (r *rawPublisher) publish(ctx context.Context, endpoint string, response map[string]any) {
+	if r == nil {
+		return
+	}
+	s := settings.Get()
+	interval := time.Duration(s.RawTopicsInterval) * time.Second
+	if last, ok := r.published[endpoint]; ok && time.Since(last) < interval {
+		return
+	}
+
+	payload, err := json.Marshal(response)
+	if err != nil {
+		log.Error("Failed to marshal raw response", "endpoint", endpoint, "error", err)
+		return
+	}
+	topic := fmt.Sprintf("%s/%s/raw/%s", s.MqttPrefix, r.vin, endpoint)
+	props := &broker.Properties{
+		ContentType: "application/json",
+		User:        map[string]string{"vin": r.vin},
+	}
+	if err := r.conn.PublishWithProperties(ctx, topic, s.RawTopicsRetain, payload, props); err != nil {
+		log.Warn("Failed to publish raw response", "topic", topic, "error", err)
+		return
+	}
+	r.published[endpoint] = time.Now()
+}
@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"TeslaBle2Mqtt/internal/settings"
+	"TeslaBle2Mqtt/pkg/proxyclient"
+	"context"
+	"sync"
+
+	"github.com/charmbracelet/log"
+)
+
+// Signal strength in dB another proxy has to be better by before the vehicle is switched to it, so
+// it does not flap between two proxies that see it about equally well
+const rssiHysteresis = 5
+
+// proxyRouter sends the requests of a vehicle to one of its proxies. The connection status is
+// requested from the proxies to choose one (--proxy-selection), every other request and command
+// goes to the chosen proxy.
+type proxyRouter struct {
+	vin       string
+	selection string
+	clients   []*proxyclient.Client
+	lock      sync.Mutex
+	current   *proxyclient.Client
+}
+
+func newProxyRouter(vin string) *proxyRouter {
+	s := settings.Get()
+	r := &proxyRouter{vin: vin, selection: s.ProxySelection}
+	for _, host := range s.ForVin(vin).ProxyHosts {
+		r.clients = append(r.clients, getProxyClient(host))
+	}
+	r.current = r.clients[0]
+	return r
+}
+
+// client returns the proxy that last saw the vehicle, the first one until any did
+func (r *proxyRouter) client() *proxyclient.Client {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.current
+}
+
+func (r *proxyRouter) use(c *proxyclient.Client) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.current != c {
+		log.Info("Switching proxy", "vin", r.vin, "from", r.current.Host(), "to", c.Host())
+		r.current = c
+	}
+}
+
+// ConnectionStatus returns the connection status from the proxy the vehicle is reached through. If
+// no proxy sees the vehicle, the status of the first one that answered is returned.
+func (r *proxyRouter) ConnectionStatus(ctx context.Context) (*proxyclient.ConnectionStatus, error) {
+	if len(r.clients) == 1 {
+		return r.clients[0].ConnectionStatus(ctx, r.vin)
+	}
+	if r.selection == "rssi" {
+		return r.strongest(ctx)
+	}
+	return r.failover(ctx)
+}
+
+// failover uses the first proxy in order that sees the vehicle
+func (r *proxyRouter) failover(ctx context.Context) (*proxyclient.ConnectionStatus, error) {
+	var not_in_range *proxyclient.ConnectionStatus
+	var last_err error
+	for _, c := range r.clients {
+		status, err := c.ConnectionStatus(ctx, r.vin)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			log.Debug("Proxy failed, trying the next one", "vin", r.vin, "host", c.Host(), "error", err)
+			last_err = err
+			continue
+		}
+		if status.InRange() {
+			r.use(c)
+			return status, nil
+		}
+		if not_in_range == nil {
+			not_in_range = status
+		}
+	}
+	if not_in_range != nil {
+		return not_in_range, nil
+	}
+	return nil, last_err
+}
+
+// strongest asks every proxy at once and uses the one with the best signal
+func (r *proxyRouter) strongest(ctx context.Context) (*proxyclient.ConnectionStatus, error) {
+	statuses := make([]*proxyclient.ConnectionStatus, len(r.clients))
+	errs := make([]error, len(r.clients))
+	var wg sync.WaitGroup
+	for i, c := range r.clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i], errs[i] = c.ConnectionStatus(ctx, r.vin)
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	current := r.client()
+	best := -1
+	for i, status := range statuses {
+		if errs[i] != nil {
+			log.Debug("Proxy failed", "vin", r.vin, "host", r.clients[i].Host(), "error", errs[i])
+			continue
+		}
+		if !status.InRange() {
+			continue
+		}
+		if best == -1 || status.Rssi > statuses[best].Rssi {
+			best = i
+		}
+	}
+	if best == -1 {
+		for _, status := range statuses {
+			if status != nil {
+				return status, nil
+			}
+		}
+		return nil, errs[len(errs)-1]
+	}
+	for i, c := range r.clients {
+		if c == current && i != best && statuses[i] != nil && statuses[i].InRange() && statuses[best].Rssi-statuses[i].Rssi < rssiHysteresis {
+			best = i
+		}
+	}
+	r.use(r.clients[best])
+	return statuses[best], nil
+}
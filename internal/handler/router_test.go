@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"TeslaBle2Mqtt/pkg/proxyclient"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// testRouter returns a router with a proxy for each mode. A mode is `fail` for an unreachable
+// proxy, `away` for a vehicle out of range or the rssi the proxy sees the vehicle with. Every
+// status has the index of its proxy as local_name.
+func testRouter(t *testing.T, selection string, count int) (*proxyRouter, []*atomic.Value) {
+	r := &proxyRouter{vin: testVin, selection: selection}
+	modes := make([]*atomic.Value, count)
+	for i := range modes {
+		mode := &atomic.Value{}
+		mode.Store("away")
+		modes[i] = mode
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			switch mode.Load() {
+			case "fail":
+				panic(http.ErrAbortHandler)
+			case "away":
+				fmt.Fprintf(w, `{"response":{"result":true,"reason":"","response":{"address":"","local_name":"%d"}}}`, i)
+			default:
+				fmt.Fprintf(w, `{"response":{"result":true,"reason":"","response":{"address":"AA:BB","local_name":"%d","rssi":%s}}}`, i, mode.Load())
+			}
+		}))
+		t.Cleanup(server.Close)
+		r.clients = append(r.clients, proxyclient.New(server.URL, proxyclient.Options{}))
+	}
+	r.current = r.clients[0]
+	return r, modes
+}
+
+// routerPoll is a connection status request with the mode of each proxy, the proxy expected to
+// answer (-1 for an error) and the one used afterwards
+type routerPoll struct {
+	modes   []string
+	status  int
+	current int
+}
+
+func testRouterPolls(t *testing.T, selection string, polls []routerPoll) {
+	r, modes := testRouter(t, selection, len(polls[0].modes))
+	for i, poll := range polls {
+		for j, mode := range poll.modes {
+			modes[j].Store(mode)
+		}
+		status, err := r.ConnectionStatus(context.Background())
+		if poll.status == -1 {
+			if err == nil {
+				t.Errorf("poll %d %v: expected an error, got %+v", i, poll.modes, status)
+			}
+		} else if err != nil {
+			t.Errorf("poll %d %v: %v", i, poll.modes, err)
+		} else if status.LocalName != fmt.Sprint(poll.status) {
+			t.Errorf("poll %d %v: got the status of proxy %s, expected %d", i, poll.modes, status.LocalName, poll.status)
+		}
+		if current := r.client(); current != r.clients[poll.current] {
+			t.Errorf("poll %d %v: using %s, expected proxy %d", i, poll.modes, current.Host(), poll.current)
+		}
+	}
+}
+
+func TestProxyRouterFailover(t *testing.T) {
+	testRouterPolls(t, "failover", []routerPoll{
+		{modes: []string{"-70", "-40"}, status: 0, current: 0},
+		{modes: []string{"fail", "-40"}, status: 1, current: 1},
+		{modes: []string{"away", "-40"}, status: 1, current: 1},
+		// Nobody sees the vehicle, the first status is returned and the proxy is kept
+		{modes: []string{"away", "away"}, status: 0, current: 1},
+		{modes: []string{"fail", "away"}, status: 1, current: 1},
+		// Back to the first proxy as soon as it sees the vehicle again
+		{modes: []string{"-70", "-40"}, status: 0, current: 0},
+		{modes: []string{"fail", "fail"}, status: -1, current: 0},
+	})
+}
+
+func TestProxyRouterStrongest(t *testing.T) {
+	testRouterPolls(t, "rssi", []routerPoll{
+		{modes: []string{"-60", "-60", "-60"}, status: 0, current: 0},
+		// Not better by the hysteresis
+		{modes: []string{"-60", "-56", "-70"}, status: 0, current: 0},
+		{modes: []string{"-60", "-55", "-70"}, status: 1, current: 1},
+		{modes: []string{"-52", "-55", "-51"}, status: 1, current: 1},
+		{modes: []string{"-52", "-55", "-50"}, status: 2, current: 2},
+		// The current proxy lost the vehicle
+		{modes: []string{"-80", "-75", "away"}, status: 1, current: 1},
+		{modes: []string{"-80", "fail", "-90"}, status: 0, current: 0},
+		// Nobody sees the vehicle, the first status is returned and the proxy is kept
+		{modes: []string{"fail", "away", "away"}, status: 1, current: 0},
+		{modes: []string{"fail", "fail", "fail"}, status: -1, current: 0},
+	})
+}
+
+func TestProxyRouterSingleProxy(t *testing.T) {
+	testRouterPolls(t, "rssi", []routerPoll{
+		{modes: []string{"-60"}, status: 0, current: 0},
+		{modes: []string{"away"}, status: 0, current: 0},
+		{modes: []string{"fail"}, status: -1, current: 0},
+	})
+}
+
+func TestProxyRouterCancelled(t *testing.T) {
+	for _, selection := range []string{"failover", "rssi"} {
+		t.Run(selection, func(t *testing.T) {
+			r, _ := testRouter(t, selection, 2)
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			if _, err := r.ConnectionStatus(ctx); err != context.Canceled {
+				t.Errorf("got %v, expected the context error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"TeslaBle2Mqtt/internal/settings"
+	"TeslaBle2Mqtt/pkg/proxyclient"
+	"context"
+	"time"
+)
+
+// endpointScheduler keeps the last response of each proxy endpoint (connection_status,
+// body_controller_state and every vehicle_data endpoint), so endpoints with an --endpoint-interval
+// are not requested on every poll
+type endpointScheduler struct {
+	values  map[string]any
+	fetched map[string]time.Time
+	// Last successful request of each endpoint, kept when the cache is cleared
+	updated map[string]time.Time
+}
+
+func newEndpointScheduler() *endpointScheduler {
+	return &endpointScheduler{
+		values:  make(map[string]any),
+		fetched: make(map[string]time.Time),
+		updated: make(map[string]time.Time),
+	}
+}
+
+// condition reports if an endpoint interval condition holds, based on the last charge_state
+func (s *endpointScheduler) condition(condition string) bool {
+	charge_state, _ := s.values["charge_state"].(map[string]any)
+	charging_state, _ := charge_state["charging_state"].(string)
+	switch condition {
+	case "plugged_in":
+		return charging_state != "" && charging_state != "Disconnected"
+	case "charging":
+		return charging_state == "Charging"
+	}
+	return false
+}
+
+// interval returns the current minimum time between requests of an endpoint
+func (s *endpointScheduler) interval(endpoint string) time.Duration {
+	seconds := 0
+	for _, interval := range settings.Get().EndpointIntervals {
+		if interval.Endpoint != endpoint {
+			continue
+		}
+		if interval.Condition == "" {
+			seconds = interval.Seconds
+		} else if s.condition(interval.Condition) {
+			return time.Duration(interval.Seconds) * time.Second
+		}
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// due returns the endpoints that have to be requested in this poll
+func (s *endpointScheduler) due(endpoints ...string) []string {
+	due := []string{}
+	for _, endpoint := range endpoints {
+		fetched, ok := s.fetched[endpoint]
+		if !ok || time.Since(fetched) >= s.interval(endpoint) {
+			due = append(due, endpoint)
+		}
+	}
+	return due
+}
+
+// set stores the response of an endpoint, nil if it was missing from the response
+func (s *endpointScheduler) set(endpoint string, value any) {
+	now := time.Now()
+	if value != nil {
+		s.values[endpoint] = value
+		s.updated[endpoint] = now
+	} else {
+		delete(s.values, endpoint)
+	}
+	s.fetched[endpoint] = now
+}
+
+// vehicleData returns the cached vehicle_data endpoints, in the same shape as a vehicle_data response
+func (s *endpointScheduler) vehicleData(endpoints []string) map[string]any {
+	data := make(map[string]any)
+	for _, endpoint := range endpoints {
+		if value, ok := s.values[endpoint]; ok {
+			data[endpoint] = value
+		}
+	}
+	return data
+}
+
+// clear drops the cached responses of the endpoints (all of them if none are given), so they are
+// requested in the next poll
+func (s *endpointScheduler) clear(endpoints ...string) {
+	if len(endpoints) == 0 {
+		clear(s.values)
+		clear(s.fetched)
+		return
+	}
+	for _, endpoint := range endpoints {
+		delete(s.values, endpoint)
+		delete(s.fetched, endpoint)
+	}
+}
+
+// freshness returns the time of the last successful request of each endpoint
+func (s *endpointScheduler) freshness() map[string]any {
+	freshness := make(map[string]any)
+	for endpoint, updated := range s.updated {
+		freshness[endpoint] = updated.Format(time.RFC3339)
+	}
+	return freshness
+}
+
+// cachedEndpoint returns the cached response of a proxy endpoint, or requests it if it is due
+func cachedEndpoint[T proxyclient.Response](ctx context.Context, p *publishStatePersistent, endpoint string, request func() (T, error)) (T, error) {
+	if len(p.endpoints.due(endpoint)) == 0 {
+		if response, ok := p.endpoints.values[endpoint].(T); ok {
+			return response, nil
+		}
+	}
+	response, err := request()
+	if err != nil {
+		return response, err
+	}
+	p.raw.publish(ctx, endpoint, response.Raw())
+	p.endpoints.set(endpoint, response)
+	return response, nil
+}
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"TeslaBle2Mqtt/internal/settings"
+	"slices"
+	"testing"
+	"time"
+)
+
+func setTestEndpointIntervals(intervals ...settings.EndpointInterval) {
+	settings.Set(&settings.Settings{EndpointIntervals: intervals})
+}
+
+func chargeState(charging_state string) map[string]any {
+	return map[string]any{"charging_state": charging_state}
+}
+
+func TestEndpointSchedulerInterval(t *testing.T) {
+	setTestEndpointIntervals(
+		settings.EndpointInterval{Endpoint: "climate_state", Seconds: 300},
+		settings.EndpointInterval{Endpoint: "charge_state", Seconds: 600},
+		// The first interval whose condition holds is used
+		settings.EndpointInterval{Endpoint: "charge_state", Seconds: 10, Condition: "charging"},
+		settings.EndpointInterval{Endpoint: "charge_state", Seconds: 60, Condition: "plugged_in"},
+		settings.EndpointInterval{Endpoint: "drive_state", Seconds: 30, Condition: "charging"},
+	)
+	tests := []struct {
+		name           string
+		charging_state string
+		endpoint       string
+		want           time.Duration
+	}{
+		{name: "no interval", endpoint: "location_data", want: 0},
+		{name: "interval", endpoint: "climate_state", want: 300 * time.Second},
+		{name: "no charge state", endpoint: "charge_state", want: 600 * time.Second},
+		{name: "disconnected", charging_state: "Disconnected", endpoint: "charge_state", want: 600 * time.Second},
+		{name: "plugged in", charging_state: "Stopped", endpoint: "charge_state", want: 60 * time.Second},
+		{name: "charging", charging_state: "Charging", endpoint: "charge_state", want: 10 * time.Second},
+		{name: "condition only, not charging", charging_state: "Stopped", endpoint: "drive_state", want: 0},
+		{name: "condition only, charging", charging_state: "Charging", endpoint: "drive_state", want: 30 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newEndpointScheduler()
+			if test.charging_state != "" {
+				s.set("charge_state", chargeState(test.charging_state))
+			}
+			if interval := s.interval(test.endpoint); interval != test.want {
+				t.Errorf("got %v, expected %v", interval, test.want)
+			}
+		})
+	}
+}
+
+func TestEndpointSchedulerDue(t *testing.T) {
+	setTestEndpointIntervals(
+		settings.EndpointInterval{Endpoint: "climate_state", Seconds: 300},
+		settings.EndpointInterval{Endpoint: "charge_state", Seconds: 600},
+		settings.EndpointInterval{Endpoint: "charge_state", Seconds: 10, Condition: "charging"},
+	)
+	endpoints := []string{"charge_state", "climate_state", "drive_state"}
+	s := newEndpointScheduler()
+	if due := s.due(endpoints...); !slices.Equal(due, endpoints) {
+		t.Fatalf("got %v, expected every endpoint at first", due)
+	}
+
+	s.set("charge_state", chargeState("Stopped"))
+	s.set("climate_state", map[string]any{"inside_temp": 20})
+	s.set("drive_state", nil)
+	if due := s.due(endpoints...); !slices.Equal(due, []string{"drive_state"}) {
+		t.Fatalf("got %v, expected the endpoint without interval", due)
+	}
+	if data := s.vehicleData(endpoints); len(data) != 2 || data["drive_state"] != nil {
+		t.Errorf("got %v, expected the endpoints with a response", data)
+	}
+
+	// The charging interval applies once charging
+	s.set("charge_state", chargeState("Charging"))
+	s.fetched["charge_state"] = time.Now().Add(-11 * time.Second)
+	s.fetched["climate_state"] = time.Now().Add(-11 * time.Second)
+	if due := s.due(endpoints...); !slices.Equal(due, []string{"charge_state", "drive_state"}) {
+		t.Fatalf("got %v while charging", due)
+	}
+
+	s.fetched["climate_state"] = time.Now().Add(-301 * time.Second)
+	if due := s.due("climate_state"); len(due) != 1 {
+		t.Fatalf("got %v after the interval", due)
+	}
+
+	// Cleared endpoints are due, their freshness is kept
+	s.set("charge_state", chargeState("Charging"))
+	s.set("climate_state", map[string]any{"inside_temp": 21})
+	s.clear("climate_state")
+	if due := s.due("charge_state", "climate_state"); !slices.Equal(due, []string{"climate_state"}) {
+		t.Fatalf("got %v after clearing climate_state", due)
+	}
+	s.clear()
+	if due := s.due(endpoints...); !slices.Equal(due, endpoints) {
+		t.Fatalf("got %v after clearing everything", due)
+	}
+	if freshness := s.freshness(); len(freshness) != 2 || freshness["climate_state"] == nil || freshness["charge_state"] == nil {
+		t.Errorf("got %v, expected the last successful requests", freshness)
+	}
+}
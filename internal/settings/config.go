@@ -0,0 +1,163 @@
+package settings
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/akamensky/argparse"
+	"gopkg.in/yaml.v3"
+)
+
+// configKey returns the configuration file key for a command line argument
+func configKey(arg argparse.Arg) string {
+	return strings.ReplaceAll(arg.GetLname(), "-", "_")
+}
+
+// configValues converts a YAML value to command line argument values
+func configValues(key string, value any) ([]string, error) {
+	switch v := value.(type) {
+	case []any:
+		values := make([]string, len(v))
+		for i, item := range v {
+			switch item.(type) {
+			case []any, map[string]any:
+				return nil, fmt.Errorf("invalid value for `%s`", key)
+			}
+			values[i] = fmt.Sprintf("%v", item)
+		}
+		return values, nil
+	case map[string]any:
+		return nil, fmt.Errorf("invalid value for `%s`", key)
+	case nil:
+		return []string{}, nil
+	default:
+		return []string{fmt.Sprintf("%v", v)}, nil
+	}
+}
+
+// setArgument validates and stores values to the result of a command line argument, as if it was parsed
+func setArgument(arg argparse.Arg, key string, values []string) error {
+	opts := arg.GetOpts()
+	if opts != nil && opts.Validate != nil && len(values) > 0 {
+		if err := opts.Validate(values); err != nil {
+			return fmt.Errorf("invalid value for `%s`: %w", key, err)
+		}
+	}
+
+	switch result := arg.GetResult().(type) {
+	case *[]string:
+		*result = values
+		return nil
+	}
+	if len(values) != 1 {
+		return fmt.Errorf("expected a single value for `%s`", key)
+	}
+	switch result := arg.GetResult().(type) {
+	case *string:
+		*result = values[0]
+	case *int:
+		value, err := strconv.Atoi(values[0])
+		if err != nil {
+			return fmt.Errorf("expected an integer for `%s`", key)
+		}
+		*result = value
+	case *bool:
+		value, err := strconv.ParseBool(values[0])
+		if err != nil {
+			return fmt.Errorf("expected a boolean for `%s`", key)
+		}
+		*result = value
+	default:
+		return fmt.Errorf("unsupported setting `%s`", key)
+	}
+	return nil
+}
+
+// loadConfigFile reads the YAML configuration file and applies it to every argument that was
+// not already set (set_keys). Returns the per vehicle overrides from the `vehicles` block.
+func loadConfigFile(parser *argparse.Parser, filename string, set_keys map[string]bool) (vehicleOverrides, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	config := make(map[string]any)
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	args := make(map[string]argparse.Arg)
+	for _, arg := range parser.GetArgs() {
+		if arg.GetLname() == "help" || arg.GetLname() == "config" {
+			continue
+		}
+		args[configKey(arg)] = arg
+	}
+
+	vehicles := make(vehicleOverrides)
+	if vehicles_config, ok := config["vehicles"]; ok {
+		vehicles_map, ok := vehicles_config.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("invalid value for `vehicles`")
+		}
+		for vin, vehicle_config := range vehicles_map {
+			vehicle_map, ok := vehicle_config.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("invalid value for `vehicles.%s`", vin)
+			}
+			vehicles[vin] = make(map[string]string)
+			for key, value := range vehicle_map {
+				values, err := configValues(key, value)
+				if err != nil {
+					return nil, err
+				}
+				// A vehicle can be reached through several proxies
+				if key == "proxy_host" {
+					values = []string{strings.Join(values, ",")}
+				}
+				if len(values) != 1 {
+					return nil, fmt.Errorf("expected a single value for `vehicles.%s.%s`", vin, key)
+				}
+				if err := validateVehicleSetting(args, vin, key, values[0]); err != nil {
+					return nil, err
+				}
+				vehicles.set(vin, key, values[0])
+			}
+		}
+		delete(config, "vehicles")
+	}
+
+	for key, value := range config {
+		arg, ok := args[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown setting `%s` in config file", key)
+		}
+		// Command line arguments and environment variables take precedence
+		if set_keys[key] {
+			continue
+		}
+		values, err := configValues(key, value)
+		if err != nil {
+			return nil, err
+		}
+		if err := setArgument(arg, key, values); err != nil {
+			return nil, err
+		}
+	}
+
+	// Vehicles with a block in the config file do not need to be listed again
+	vin_arg := args["vin"]
+	vins := vin_arg.GetResult().(*[]string)
+	for vin := range vehicles {
+		if err := vin_arg.GetOpts().Validate([]string{vin}); err != nil {
+			return nil, fmt.Errorf("invalid value for `vehicles`: %w", err)
+		}
+		if !set_keys["vin"] && !slices.Contains(*vins, vin) {
+			*vins = append(*vins, vin)
+		}
+	}
+
+	return vehicles, nil
+}
@@ -0,0 +1,171 @@
+package settings
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/akamensky/argparse"
+)
+
+// testArgs is a parser with a few arguments of each type, like the one of parseSettings
+type testArgs struct {
+	parser         *argparse.Parser
+	vins           *[]string
+	proxy_hosts    *[]string
+	poll_interval  *int
+	mqtt_pass      *string
+	mqtt_v5        *bool
+	mqtt_ws_header *[]string
+}
+
+func newTestArgs(t *testing.T, args ...string) *testArgs {
+	parser := argparse.NewParser("test", "")
+	a := &testArgs{parser: parser}
+	parser.String("c", "config", &argparse.Options{})
+	a.vins = parser.List("v", "vin", &argparse.Options{Validate: func(args []string) error {
+		for _, vin := range args {
+			if len(vin) != 17 {
+				return fmt.Errorf("invalid VIN (%s)", vin)
+			}
+		}
+		return nil
+	}})
+	a.proxy_hosts = parser.List("p", "proxy-host", &argparse.Options{Default: []string{"http://localhost:8080"}})
+	a.poll_interval = parser.Int("i", "poll-interval", &argparse.Options{Default: 90})
+	a.mqtt_pass = parser.String("w", "mqtt-pass", &argparse.Options{})
+	a.mqtt_v5 = parser.Flag("5", "mqtt-v5", &argparse.Options{})
+	a.mqtt_ws_header = parser.List("", "mqtt-ws-header", &argparse.Options{Validate: validHeaders("MQTT WebSocket header")})
+	if err := parser.Parse(append([]string{"test"}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+const (
+	testVin1 = "5YJ3E1EA1KF000001"
+	testVin2 = "5YJ3E1EA1KF000002"
+)
+
+func writeTestFile(t *testing.T, name string, content string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name          string
+		args          []string
+		env           map[string]string
+		config        string
+		vins          []string
+		proxy_hosts   []string
+		poll_interval int
+		mqtt_pass     string
+		mqtt_v5       bool
+		vehicles      vehicleOverrides
+		err           string
+	}{
+		{
+			name:          "values",
+			config:        "vin: " + testVin1 + "\npoll_interval: 30\nmqtt_pass: secret\nmqtt_v5: true\nproxy_host: [http://a:8080, http://b:8080]\n",
+			vins:          []string{testVin1},
+			proxy_hosts:   []string{"http://a:8080", "http://b:8080"},
+			poll_interval: 30,
+			mqtt_pass:     "secret",
+			mqtt_v5:       true,
+		},
+		{
+			name:          "command line over config file",
+			args:          []string{"-i", "10", "-v", testVin2},
+			config:        "vin: " + testVin1 + "\npoll_interval: 30\nmqtt_pass: secret\n",
+			vins:          []string{testVin2},
+			poll_interval: 10,
+			mqtt_pass:     "secret",
+		},
+		{
+			name:          "environment over config file",
+			env:           map[string]string{"TB2M_POLL_INTERVAL": "20", "TB2M_MQTT_PASS": "from env"},
+			config:        "vin: " + testVin1 + "\npoll_interval: 30\nmqtt_pass: secret\n",
+			vins:          []string{testVin1},
+			poll_interval: 20,
+			mqtt_pass:     "from env",
+		},
+		{
+			name:          "vehicles add their vin",
+			config:        "vin: [" + testVin1 + "]\nvehicles:\n  " + testVin2 + ":\n    name: Second\n    poll_interval: 15\n",
+			vins:          []string{testVin1, testVin2},
+			poll_interval: 90,
+			vehicles:      vehicleOverrides{testVin2: {"name": "Second", "poll_interval": "15"}},
+		},
+		{
+			name:          "vehicles do not add their vin to a command line vin",
+			args:          []string{"-v", testVin1},
+			config:        "vehicles:\n  " + testVin2 + ":\n    name: Second\n",
+			vins:          []string{testVin1},
+			poll_interval: 90,
+			vehicles:      vehicleOverrides{testVin2: {"name": "Second"}},
+		},
+		{
+			name:          "vehicle proxy hosts",
+			config:        "vehicles:\n  " + testVin1 + ":\n    proxy_host: [http://a:8080, http://b:8080]\n",
+			vins:          []string{testVin1},
+			poll_interval: 90,
+			vehicles:      vehicleOverrides{testVin1: {"proxy_host": "http://a:8080,http://b:8080"}},
+		},
+		{name: "unknown setting", config: "pol_interval: 30\n", err: "unknown setting `pol_interval`"},
+		{name: "invalid value", config: "vin: short\n", err: "invalid value for `vin`"},
+		{name: "invalid integer", config: "poll_interval: often\n", err: "expected an integer for `poll_interval`"},
+		{name: "object value", config: "mqtt_pass:\n  a: b\n", err: "invalid value for `mqtt_pass`"},
+		{name: "list for a single value", config: "mqtt_pass: [a, b]\n", err: "expected a single value for `mqtt_pass`"},
+		{name: "invalid list item", config: "mqtt_ws_header: [nocolon]\n", err: "invalid MQTT WebSocket header"},
+		{name: "invalid vehicle vin", config: "vehicles:\n  short:\n    name: x\n", err: "invalid value for `vehicles`"},
+		{name: "unknown vehicle setting", config: "vehicles:\n  " + testVin1 + ":\n    mqtt_pass: x\n", err: "unknown vehicle setting `mqtt_pass`"},
+		{name: "invalid vehicles", config: "vehicles: [a]\n", err: "invalid value for `vehicles`"},
+		{name: "invalid yaml", config: "vin: [\n", err: "failed to parse config file"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+			a := newTestArgs(t, test.args...)
+			set_keys, err := loadEnv(a.parser)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vehicles, err := loadConfigFile(a.parser, writeTestFile(t, "config.yaml", test.config), set_keys)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(*a.vins, test.vins) {
+				t.Errorf("vins %v, expected %v", *a.vins, test.vins)
+			}
+			if test.proxy_hosts != nil && !slices.Equal(*a.proxy_hosts, test.proxy_hosts) {
+				t.Errorf("proxy hosts %v, expected %v", *a.proxy_hosts, test.proxy_hosts)
+			}
+			if *a.poll_interval != test.poll_interval || *a.mqtt_pass != test.mqtt_pass || *a.mqtt_v5 != test.mqtt_v5 {
+				t.Errorf("poll interval %d, mqtt pass %q, mqtt v5 %v", *a.poll_interval, *a.mqtt_pass, *a.mqtt_v5)
+			}
+			if test.vehicles == nil {
+				test.vehicles = vehicleOverrides{}
+			}
+			if !reflect.DeepEqual(vehicles, test.vehicles) {
+				t.Errorf("vehicles %v, expected %v", vehicles, test.vehicles)
+			}
+		})
+	}
+}
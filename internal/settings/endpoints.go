@@ -0,0 +1,40 @@
+package settings
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Conditions an endpoint interval can be limited to, evaluated on the last charge_state
+var endpointConditions = []string{"plugged_in", "charging"}
+
+// EndpointInterval is the minimum time between requests of a proxy endpoint. With a condition it
+// only applies while the condition holds, and takes precedence over the interval without one.
+type EndpointInterval struct {
+	Endpoint  string
+	Seconds   int
+	Condition string
+}
+
+// parseEndpointInterval parses a `ENDPOINT=SECONDS[:CONDITION]` endpoint interval
+func parseEndpointInterval(option string) (EndpointInterval, error) {
+	var interval EndpointInterval
+	endpoint, value, ok := strings.Cut(option, "=")
+	if !ok || endpoint == "" {
+		return interval, fmt.Errorf("invalid endpoint interval (%s), expected ENDPOINT=SECONDS[:CONDITION]", option)
+	}
+	value, condition, _ := strings.Cut(value, ":")
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return interval, fmt.Errorf("invalid endpoint interval (%s), expected ENDPOINT=SECONDS[:CONDITION]", option)
+	}
+	if condition != "" && !slices.Contains(endpointConditions, condition) {
+		return interval, fmt.Errorf("unknown endpoint interval condition `%s`, expected one of %s", condition, strings.Join(endpointConditions, ", "))
+	}
+	interval.Endpoint = endpoint
+	interval.Seconds = seconds
+	interval.Condition = condition
+	return interval, nil
+}
@@ -0,0 +1,71 @@
+package settings
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/akamensky/argparse"
+)
+
+const envPrefix = "TB2M_"
+
+// envKey returns the environment variable name for a command line argument
+func envKey(arg argparse.Arg) string {
+	return envPrefix + strings.ToUpper(configKey(arg))
+}
+
+// envValue returns the value of the environment variable for an argument, `TB2M_KEY_FILE`
+// reads the value from a file (e.g. Docker secrets)
+func envValue(arg argparse.Arg) (string, bool, error) {
+	key := envKey(arg)
+	if value, ok := os.LookupEnv(key); ok {
+		return value, true, nil
+	}
+	if filename, ok := os.LookupEnv(key + "_FILE"); ok {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to read %s_FILE: %w", key, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), true, nil
+	}
+	return "", false, nil
+}
+
+// loadEnv applies environment variables to every argument that was not given on the command line.
+// Returns the config keys of the arguments that were set.
+func loadEnv(parser *argparse.Parser) (map[string]bool, error) {
+	set_keys := make(map[string]bool)
+	for _, arg := range parser.GetArgs() {
+		if arg.GetLname() == "help" {
+			continue
+		}
+		key := configKey(arg)
+		if arg.GetParsed() {
+			set_keys[key] = true
+			continue
+		}
+		value, ok, err := envValue(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		values := []string{value}
+		if _, is_list := arg.GetResult().(*[]string); is_list {
+			// Lists are comma separated
+			values = []string{}
+			for _, v := range strings.Split(value, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					values = append(values, v)
+				}
+			}
+		}
+		if err := setArgument(arg, envKey(arg), values); err != nil {
+			return nil, err
+		}
+		set_keys[key] = true
+	}
+	return set_keys, nil
+}
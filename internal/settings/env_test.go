@@ -0,0 +1,100 @@
+package settings
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadEnv(t *testing.T) {
+	secret := writeTestFile(t, "secret", "from file\r\n")
+	tests := []struct {
+		name          string
+		args          []string
+		env           map[string]string
+		vins          []string
+		poll_interval int
+		mqtt_pass     string
+		mqtt_v5       bool
+		set_keys      []string
+		err           string
+	}{
+		{
+			name:          "nothing set",
+			poll_interval: 90,
+			set_keys:      []string{},
+		},
+		{
+			name:          "values",
+			env:           map[string]string{"TB2M_VIN": testVin1 + ", " + testVin2 + ",", "TB2M_POLL_INTERVAL": "30", "TB2M_MQTT_PASS": "secret", "TB2M_MQTT_V5": "true"},
+			vins:          []string{testVin1, testVin2},
+			poll_interval: 30,
+			mqtt_pass:     "secret",
+			mqtt_v5:       true,
+			set_keys:      []string{"vin", "poll_interval", "mqtt_pass", "mqtt_v5"},
+		},
+		{
+			name:          "command line over environment",
+			args:          []string{"-i", "10", "-v", testVin1},
+			env:           map[string]string{"TB2M_VIN": testVin2, "TB2M_POLL_INTERVAL": "30"},
+			vins:          []string{testVin1},
+			poll_interval: 10,
+			set_keys:      []string{"vin", "poll_interval"},
+		},
+		{
+			name:          "value from file",
+			env:           map[string]string{"TB2M_MQTT_PASS_FILE": secret},
+			poll_interval: 90,
+			mqtt_pass:     "from file",
+			set_keys:      []string{"mqtt_pass"},
+		},
+		{
+			name:          "value over file",
+			env:           map[string]string{"TB2M_MQTT_PASS": "secret", "TB2M_MQTT_PASS_FILE": secret},
+			poll_interval: 90,
+			mqtt_pass:     "secret",
+			set_keys:      []string{"mqtt_pass"},
+		},
+		{
+			name:          "command line over file",
+			args:          []string{"-w", "from args"},
+			env:           map[string]string{"TB2M_MQTT_PASS_FILE": secret},
+			poll_interval: 90,
+			mqtt_pass:     "from args",
+			set_keys:      []string{"mqtt_pass"},
+		},
+		{name: "missing file", env: map[string]string{"TB2M_MQTT_PASS_FILE": secret + ".missing"}, err: "failed to read TB2M_MQTT_PASS_FILE"},
+		{name: "invalid value", env: map[string]string{"TB2M_VIN": "short"}, err: "invalid value for `TB2M_VIN`"},
+		{name: "invalid integer", env: map[string]string{"TB2M_POLL_INTERVAL": "often"}, err: "expected an integer for `TB2M_POLL_INTERVAL`"},
+		{name: "invalid boolean", env: map[string]string{"TB2M_MQTT_V5": "maybe"}, err: "expected a boolean for `TB2M_MQTT_V5`"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+			a := newTestArgs(t, test.args...)
+			set_keys, err := loadEnv(a.parser)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(*a.vins, test.vins) {
+				t.Errorf("vins %v, expected %v", *a.vins, test.vins)
+			}
+			if *a.poll_interval != test.poll_interval || *a.mqtt_pass != test.mqtt_pass || *a.mqtt_v5 != test.mqtt_v5 {
+				t.Errorf("poll interval %d, mqtt pass %q, mqtt v5 %v", *a.poll_interval, *a.mqtt_pass, *a.mqtt_v5)
+			}
+			keys := slices.Sorted(maps.Keys(set_keys))
+			if !slices.Equal(keys, slices.Sorted(slices.Values(test.set_keys))) {
+				t.Errorf("set keys %v, expected %v", keys, test.set_keys)
+			}
+		})
+	}
+}
@@ -4,35 +4,125 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 
 	"github.com/akamensky/argparse"
 	"github.com/charmbracelet/log"
 )
 
 type Settings struct {
+	ConfigFile               string
 	Vins                     []string
-	ProxyHost                string
+	ProxyHosts               []string
+	ProxySelection           string
 	PollInterval             int
 	PollIntervalCharging     int
 	PollIntervalDisconnected int
 	FastPollTime             int
 	MaxChargingAmps          int
+	EndpointIntervals        []EndpointInterval
+	PollPolicy               string
+	ProxyRetries             int
+	ProxyRetryBackoff        int
+	ProxyBreakerThreshold    int
+	ProxyBreakerCooldown     int
+	ProxyTimeout             int
+	ProxyCommandTimeout      int
+	ProxyToken               string
+	ProxyUser                string
+	ProxyPass                string
+	ProxyHeaders             []string
+	ProxyCaFile              string
 	MqttHost                 string
 	MqttPort                 int
+	MqttWsPath               string
+	MqttWsHeaders            []string
 	MqttUser                 string
 	MqttPass                 string
 	MqttQos                  byte
+	MqttV5                   bool
+	MqttMessageExpiry        int
+	MqttPersistentSession    bool
+	MqttStoreDir             string
+	OfflineQueueSize         int
+	OfflineQueuePolicy       string
+	MqttTls                  bool
+	MqttCaFile               string
+	MqttCertFile             string
+	MqttKeyFile              string
+	MqttInsecure             bool
+	MqttServerName           string
 	DiscoveryPrefix          string
 	MqttPrefix               string
 	ResetDiscovery           bool
 	SensorsYaml              string
+	SensorsOverlays          []string
+	RawTopics                bool
+	RawTopicsRetain          bool
+	RawTopicsInterval        int
 	LogLevel                 string
 	MqttDebug                bool
 	ReportedVersion          string
 	ReportedConfigUrl        string
 	ForceAnsiColor           bool
 	LogPrefix                string
+	Vehicles                 map[string]VehicleSettings
+}
+
+// String formats the settings with secrets redacted, so they can be logged
+func (s *Settings) String() string {
+	type plain Settings
+	redacted := plain(*s)
+	if redacted.MqttPass != "" {
+		redacted.MqttPass = "<redacted>"
+	}
+	if redacted.ProxyPass != "" {
+		redacted.ProxyPass = "<redacted>"
+	}
+	if redacted.ProxyToken != "" {
+		redacted.ProxyToken = "<redacted>"
+	}
+	redacted.MqttWsHeaders = redactHeaders(s.MqttWsHeaders)
+	redacted.ProxyHeaders = redactHeaders(s.ProxyHeaders)
+	return fmt.Sprintf("%+v", redacted)
+}
+
+// redactHeaders only keeps the names of `Name: value` headers, as they often carry credentials
+func redactHeaders(headers []string) []string {
+	redacted := make([]string, len(headers))
+	for i, header := range headers {
+		name, _, _ := strings.Cut(header, ":")
+		redacted[i] = name + ": <redacted>"
+	}
+	return redacted
+}
+
+// VehicleSettings are the settings that can be different for each vehicle
+type VehicleSettings struct {
+	Name                     string
+	ProxyHosts               []string
+	PollInterval             int
+	PollIntervalCharging     int
+	PollIntervalDisconnected int
+	FastPollTime             int
+	MaxChargingAmps          int
+}
+
+// ForVin returns the settings for the given vehicle, falling back to the global settings
+func (s *Settings) ForVin(vin string) VehicleSettings {
+	if v, ok := s.Vehicles[vin]; ok {
+		return v
+	}
+	return VehicleSettings{
+		ProxyHosts:               s.ProxyHosts,
+		PollInterval:             s.PollInterval,
+		PollIntervalCharging:     s.PollIntervalCharging,
+		PollIntervalDisconnected: s.PollIntervalDisconnected,
+		FastPollTime:             s.FastPollTime,
+		MaxChargingAmps:          s.MaxChargingAmps,
+	}
 }
 
 var settings *Settings
@@ -45,9 +135,17 @@ func Get() *Settings {
 	return settings
 }
 
+// Set replaces the settings returned by Get, so tests do not parse the command line
+func Set(s *Settings) {
+	settings = s
+}
+
 func parseSettings(settings *Settings) {
-	parser := argparse.NewParser("Tesla BLE to Mqtt", "Expose Tesla sensors and controls to MQTT with Home Assistant discovery")
-	vins := parser.List("v", "vin", &argparse.Options{Required: true, Help: "VIN of the Tesla vehicle (Can be specified multiple times)", Validate: func(args []string) error {
+	parser := argparse.NewParser("Tesla BLE to Mqtt", "Expose Tesla sensors and controls to MQTT with Home Assistant discovery. "+
+		"Every argument can also be set with a TB2M_<ARGUMENT> environment variable (e.g. TB2M_MQTT_PASS, lists are comma separated) "+
+		"or read from a file with TB2M_<ARGUMENT>_FILE. Run `validate --help` or `render --help` to check a sensors YAML file or print what it generates instead")
+	config_file := parser.String("c", "config", &argparse.Options{Required: false, Help: "Path to YAML config file, keys are argument names with `_` instead of `-` (arguments override config file values)"})
+	vins := parser.List("v", "vin", &argparse.Options{Required: false, Help: "VIN of the Tesla vehicle (Can be specified multiple times, required)", Validate: func(args []string) error {
 		for _, vin := range args {
 			if len(vin) != 17 {
 				return fmt.Errorf("invalid VIN (%s)", vin)
@@ -55,17 +153,35 @@ func parseSettings(settings *Settings) {
 		}
 		return nil
 	}})
-	proxy_host := parser.String("p", "proxy-host", &argparse.Options{Required: false, Help: "Proxy host", Default: "http://localhost:8080", Validate: func(args []string) error {
-		// Check if the proxy host is a valid URL
-		url, err := url.Parse(args[0])
-		if err != nil {
-			return fmt.Errorf("invalid proxy host (%s)", err)
+	proxy_hosts := parser.List("p", "proxy-host", &argparse.Options{Required: false, Help: "Proxy host, with several proxies the vehicle is reached through the one chosen by --proxy-selection (Can be specified multiple times or comma separated)", Default: []string{"http://localhost:8080"}, Validate: func(args []string) error {
+		for _, host := range splitProxyHosts(args) {
+			// Check if the proxy host is a valid URL
+			url, err := url.Parse(host)
+			if err != nil {
+				return fmt.Errorf("invalid proxy host (%s)", err)
+			}
+			if url.Scheme != "http" && url.Scheme != "https" {
+				return fmt.Errorf("invalid proxy host scheme")
+			}
 		}
-		if url.Scheme != "http" && url.Scheme != "https" {
-			return fmt.Errorf("invalid proxy host scheme")
+		return nil
+	}})
+	// argparse only checks selector values given on the command line, not the ones from the config file or environment
+	oneOf := func(name string, choices []string) func(args []string) error {
+		return func(args []string) error {
+			if !slices.Contains(choices, args[0]) {
+				return fmt.Errorf("invalid %s (%s), allowed values are %s", name, args[0], strings.Join(choices, ", "))
+			}
+			return nil
 		}
-		if url.Path != "" {
-			return fmt.Errorf("invalid proxy host path")
+	}
+	proxy_selections := []string{"failover", "rssi"}
+	proxy_selection := parser.Selector("", "proxy-selection", proxy_selections, &argparse.Options{Required: false, Help: "How the proxy of a vehicle is chosen when there are several: failover uses the first proxy that sees the vehicle, rssi the one with the strongest signal", Default: "failover", Validate: oneOf("proxy selection", proxy_selections)})
+	vin_options := parser.List("", "vin-option", &argparse.Options{Required: false, Help: "Per vehicle setting as VIN:key=value, keys are name, proxy_host (comma separated for several proxies), poll_interval, poll_interval_charging, poll_interval_disconnected, fast_poll_time and max_charging_amps (Can be specified multiple times)", Validate: func(args []string) error {
+		for _, option := range args {
+			if _, _, _, err := parseVinOption(option); err != nil {
+				return err
+			}
 		}
 		return nil
 	}})
@@ -83,8 +199,28 @@ func parseSettings(settings *Settings) {
 		}
 		return nil
 	}})
-	mqtt_host := parser.String("H", "mqtt-host", &argparse.Options{Required: false, Help: "MQTT host", Default: "localhost"})
-	mqtt_port := parser.Int("P", "mqtt-port", &argparse.Options{Required: false, Help: "MQTT port", Default: 1883})
+	mqtt_host := parser.String("H", "mqtt-host", &argparse.Options{Required: false, Help: "MQTT host or broker URI (tcp://, ssl://, ws:// or wss://)", Default: "localhost", Validate: func(args []string) error {
+		if !strings.Contains(args[0], "://") {
+			return nil
+		}
+		// Check if the broker URI is valid
+		url, err := url.Parse(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid MQTT broker URI (%s)", err)
+		}
+		switch url.Scheme {
+		case "tcp", "ssl", "ws", "wss":
+		default:
+			return fmt.Errorf("invalid MQTT broker URI scheme (%s)", url.Scheme)
+		}
+		if url.Hostname() == "" {
+			return fmt.Errorf("invalid MQTT broker URI host")
+		}
+		return nil
+	}})
+	mqtt_port := parser.Int("P", "mqtt-port", &argparse.Options{Required: false, Help: "MQTT port (used when --mqtt-host is not an URI or the URI has no port)", Default: 1883})
+	mqtt_ws_path := parser.String("", "mqtt-ws-path", &argparse.Options{Required: false, Help: "Path of the MQTT WebSocket endpoint (overrides the path in --mqtt-host)"})
+	mqtt_ws_headers := parser.List("", "mqtt-ws-header", &argparse.Options{Required: false, Help: "Extra HTTP header sent with the MQTT WebSocket handshake as `Name: value` (Can be specified multiple times)", Validate: validHeaders("MQTT WebSocket header")})
 	mqtt_user := parser.String("u", "mqtt-user", &argparse.Options{Required: false, Help: "MQTT username"})
 	mqtt_pass := parser.String("w", "mqtt-pass", &argparse.Options{Required: false, Help: "MQTT password"})
 	mqtt_qos := parser.Int("q", "mqtt-qos", &argparse.Options{Required: false, Help: "MQTT QoS", Default: 0, Validate: func(args []string) error {
@@ -97,9 +233,78 @@ func parseSettings(settings *Settings) {
 		}
 		return nil
 	}})
+	mqtt_v5 := parser.Flag("5", "mqtt-v5", &argparse.Options{Required: false, Help: "Use MQTT 5 (enables command responses via response topic and correlation data)"})
+	mqtt_message_expiry := parser.Int("", "mqtt-message-expiry", &argparse.Options{Required: false, Help: "Message expiry interval in seconds for state messages, 0 for no expiry (MQTT 5 only)", Default: 0})
+	mqtt_persistent_session := parser.Flag("", "mqtt-persistent-session", &argparse.Options{Required: false, Help: "Keep the MQTT session on the broker between connections (clean session disabled)"})
+	mqtt_store_dir := parser.String("", "mqtt-store-dir", &argparse.Options{Required: false, Help: "Directory for the persistent MQTT session store and offline queue (in memory if not set)"})
+	offline_queue_size := parser.Int("", "offline-queue-size", &argparse.Options{Required: false, Help: "Max number of state changes buffered while the MQTT broker is unreachable, 0 to disable", Default: 0, Validate: func(args []string) error {
+		size, err := strconv.Atoi(args[0])
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid offline queue size")
+		}
+		return nil
+	}})
+	offline_queue_policies := []string{"drop-oldest", "drop-newest", "coalesce"}
+	offline_queue_policy := parser.Selector("", "offline-queue-policy", offline_queue_policies, &argparse.Options{Required: false, Help: "What to drop when the offline queue is full (coalesce keeps only the latest state per topic)", Default: "drop-oldest", Validate: oneOf("offline queue policy", offline_queue_policies)})
+	fileExists := func(args []string) error {
+		if _, err := os.Stat(args[0]); err != nil {
+			return fmt.Errorf("invalid file (%s)", err)
+		}
+		return nil
+	}
+	mqtt_tls := parser.Flag("", "mqtt-tls", &argparse.Options{Required: false, Help: "Use TLS for the MQTT connection (implied by any other --mqtt-tls-* option)"})
+	mqtt_ca_file := parser.String("", "mqtt-tls-ca", &argparse.Options{Required: false, Help: "Path to CA bundle (PEM) used to verify the MQTT broker", Validate: fileExists})
+	mqtt_cert_file := parser.String("", "mqtt-tls-cert", &argparse.Options{Required: false, Help: "Path to client certificate (PEM) for MQTT mutual TLS", Validate: fileExists})
+	mqtt_key_file := parser.String("", "mqtt-tls-key", &argparse.Options{Required: false, Help: "Path to client private key (PEM) for MQTT mutual TLS", Validate: fileExists})
+	mqtt_insecure := parser.Flag("", "mqtt-tls-insecure", &argparse.Options{Required: false, Help: "Skip verification of the MQTT broker certificate"})
+	mqtt_server_name := parser.String("", "mqtt-tls-server-name", &argparse.Options{Required: false, Help: "Server name used to verify the MQTT broker certificate (defaults to --mqtt-host)"})
 	discovery_prefix := parser.String("d", "discovery-prefix", &argparse.Options{Required: false, Help: "MQTT discovery prefix", Default: "homeassistant"})
 	mqtt_prefix := parser.String("m", "mqtt-prefix", &argparse.Options{Required: false, Help: "MQTT prefix", Default: "tb2m"})
 	sensors_yaml := parser.String("y", "sensors-yaml", &argparse.Options{Required: false, Help: "Path to custom sensors YAML file", Default: ""})
+	sensors_overlays := parser.List("Y", "sensors-overlay", &argparse.Options{Required: false, Help: "Path to sensors YAML file deep merged onto the sensors configuration, to add, change or delete (__delete: true) components (Can be specified multiple times)", Validate: func(args []string) error {
+		for _, arg := range args {
+			if err := fileExists([]string{arg}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}})
+	nonNegative := func(name string) func(args []string) error {
+		return func(args []string) error {
+			if i, err := strconv.Atoi(args[0]); err != nil || i < 0 {
+				return fmt.Errorf("invalid %s", name)
+			}
+			return nil
+		}
+	}
+	proxy_retries := parser.Int("", "proxy-retries", &argparse.Options{Required: false, Help: "Number of retries of a failed proxy status request, if the failure looks temporary (commands are never retried)", Default: 2, Validate: nonNegative("proxy retries")})
+	proxy_retry_backoff := parser.Int("", "proxy-retry-backoff", &argparse.Options{Required: false, Help: "Wait before the first retry in milliseconds, doubled with each retry", Default: 500, Validate: nonNegative("proxy retry backoff")})
+	proxy_breaker_threshold := parser.Int("", "proxy-breaker-threshold", &argparse.Options{Required: false, Help: "Failed proxy requests in a row after which the proxy is not polled until --proxy-breaker-cooldown passes (0 disables)", Default: 5, Validate: nonNegative("proxy breaker threshold")})
+	proxy_breaker_cooldown := parser.Int("", "proxy-breaker-cooldown", &argparse.Options{Required: false, Help: "Seconds before the proxy is tried again after too many failed requests", Default: 60, Validate: nonNegative("proxy breaker cooldown")})
+	proxy_timeout := parser.Int("", "proxy-timeout", &argparse.Options{Required: false, Help: "Timeout of a proxy status request in seconds, each retry has its own timeout (0 disables)", Default: 15, Validate: nonNegative("proxy timeout")})
+	proxy_command_timeout := parser.Int("", "proxy-command-timeout", &argparse.Options{Required: false, Help: "Timeout of a command in seconds, commands wait until the vehicle has executed them and might have to wake it up (0 disables)", Default: 90, Validate: nonNegative("proxy command timeout")})
+	proxy_token := parser.String("", "proxy-token", &argparse.Options{Required: false, Help: "Bearer token sent to the proxy, e.g. when it is behind an authenticating reverse proxy"})
+	proxy_user := parser.String("", "proxy-user", &argparse.Options{Required: false, Help: "Username for basic authentication with the proxy"})
+	proxy_pass := parser.String("", "proxy-pass", &argparse.Options{Required: false, Help: "Password for basic authentication with the proxy"})
+	proxy_headers := parser.List("", "proxy-header", &argparse.Options{Required: false, Help: "Extra HTTP header sent with every proxy request as `Name: value` (Can be specified multiple times)", Validate: validHeaders("proxy header")})
+	proxy_ca_file := parser.String("", "proxy-tls-ca", &argparse.Options{Required: false, Help: "Path to CA bundle (PEM) used to verify an https proxy", Validate: fileExists})
+	poll_policy := parser.String("", "poll-policy", &argparse.Options{Required: false, Help: "Path to YAML file with rules that set the poll interval based on the vehicle state", Validate: fileExists})
+	endpoint_intervals := parser.List("", "endpoint-interval", &argparse.Options{Required: false, Help: "Request a proxy endpoint (connection_status, body_controller_state or a vehicle_data endpoint) at most every SECONDS, as ENDPOINT=SECONDS[:CONDITION] where CONDITION is " + strings.Join(endpointConditions, " or ") + ". Cached data is published in between (Can be specified multiple times)", Validate: func(args []string) error {
+		for _, arg := range args {
+			if _, err := parseEndpointInterval(arg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}})
+	raw_topics := parser.Flag("", "raw-topics", &argparse.Options{Required: false, Help: "Publish the raw proxy responses to <mqtt-prefix>/<vin>/raw/<endpoint> for debugging"})
+	raw_topics_retain := parser.Flag("", "raw-topics-retain", &argparse.Options{Required: false, Help: "Retain the raw proxy responses"})
+	raw_topics_interval := parser.Int("", "raw-topics-interval", &argparse.Options{Required: false, Help: "Minimum time between raw proxy responses of the same endpoint in seconds (0 publishes on every poll)", Default: 0, Validate: func(args []string) error {
+		if i, err := strconv.Atoi(args[0]); err != nil || i < 0 {
+			return fmt.Errorf("invalid raw topics interval")
+		}
+		return nil
+	}})
 	reset_discovery := parser.Flag("r", "reset-discovery", &argparse.Options{Required: false, Help: "Reset MQTT discovery"})
 	log_level := parser.String("l", "log-level", &argparse.Options{Required: false, Help: "Log level", Default: "INFO", Validate: func(args []string) error {
 		if _, err := log.ParseLevel(args[0]); err != nil {
@@ -119,26 +324,112 @@ func parseSettings(settings *Settings) {
 		os.Exit(1)
 	}
 
+	set_keys, err := loadEnv(parser)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	vehicle_overrides := make(vehicleOverrides)
+	if *config_file != "" {
+		vehicle_overrides, err = loadConfigFile(parser, *config_file, set_keys)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if len(*vins) == 0 {
+		fmt.Println("[-v|--vin] is required")
+		os.Exit(1)
+	}
+	if len(splitProxyHosts(*proxy_hosts)) == 0 {
+		fmt.Println("[-p|--proxy-host] is required")
+		os.Exit(1)
+	}
+	if *proxy_token != "" && *proxy_user != "" {
+		fmt.Println("[--proxy-token] and [--proxy-user] can not be used together")
+		os.Exit(1)
+	}
+
+	// Vehicle options override the config file
+	args := make(map[string]argparse.Arg)
+	for _, arg := range parser.GetArgs() {
+		args[configKey(arg)] = arg
+	}
+	if err := vehicle_overrides.setVinOptions(args, *vins, *vin_options); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	settings.ConfigFile = *config_file
 	settings.LogLevel = *log_level
 	settings.Vins = *vins
-	settings.ProxyHost = *proxy_host
+	settings.ProxyHosts = splitProxyHosts(*proxy_hosts)
+	settings.ProxySelection = *proxy_selection
 	settings.PollInterval = *poll_interval
 	settings.PollIntervalCharging = *poll_interval_charging
 	settings.PollIntervalDisconnected = *poll_interval_disconnected
 	settings.FastPollTime = *fast_poll_time
 	settings.MaxChargingAmps = *max_charging_amps
+	settings.PollPolicy = *poll_policy
+	settings.ProxyRetries = *proxy_retries
+	settings.ProxyRetryBackoff = *proxy_retry_backoff
+	settings.ProxyBreakerThreshold = *proxy_breaker_threshold
+	settings.ProxyBreakerCooldown = *proxy_breaker_cooldown
+	settings.ProxyTimeout = *proxy_timeout
+	settings.ProxyCommandTimeout = *proxy_command_timeout
+	settings.ProxyToken = *proxy_token
+	settings.ProxyUser = *proxy_user
+	settings.ProxyPass = *proxy_pass
+	settings.ProxyHeaders = *proxy_headers
+	settings.ProxyCaFile = *proxy_ca_file
+	settings.EndpointIntervals = []EndpointInterval{}
+	for _, option := range *endpoint_intervals {
+		interval, _ := parseEndpointInterval(option)
+		settings.EndpointIntervals = append(settings.EndpointIntervals, interval)
+	}
 	settings.MqttHost = *mqtt_host
 	settings.MqttPort = *mqtt_port
+	settings.MqttWsPath = *mqtt_ws_path
+	settings.MqttWsHeaders = *mqtt_ws_headers
 	settings.MqttUser = *mqtt_user
 	settings.MqttPass = *mqtt_pass
 	settings.MqttQos = byte(*mqtt_qos)
+	settings.MqttV5 = *mqtt_v5
+	settings.MqttMessageExpiry = *mqtt_message_expiry
+	settings.MqttPersistentSession = *mqtt_persistent_session
+	settings.MqttStoreDir = *mqtt_store_dir
+	settings.OfflineQueueSize = *offline_queue_size
+	settings.OfflineQueuePolicy = *offline_queue_policy
+	settings.MqttTls = *mqtt_tls
+	settings.MqttCaFile = *mqtt_ca_file
+	settings.MqttCertFile = *mqtt_cert_file
+	settings.MqttKeyFile = *mqtt_key_file
+	settings.MqttInsecure = *mqtt_insecure
+	settings.MqttServerName = *mqtt_server_name
 	settings.DiscoveryPrefix = *discovery_prefix
 	settings.MqttPrefix = *mqtt_prefix
 	settings.ResetDiscovery = *reset_discovery
 	settings.SensorsYaml = *sensors_yaml
+	settings.SensorsOverlays = *sensors_overlays
+	settings.RawTopics = *raw_topics
+	settings.RawTopicsRetain = *raw_topics_retain
+	settings.RawTopicsInterval = *raw_topics_interval
 	settings.MqttDebug = *mqtt_debug
 	settings.ReportedVersion = *reported_version
 	settings.ReportedConfigUrl = *reported_config_url
 	settings.ForceAnsiColor = *force_ansi_color
 	settings.LogPrefix = *log_prefix
+
+	settings.Vehicles = make(map[string]VehicleSettings)
+	for _, vin := range settings.Vins {
+		v := settings.ForVin(vin)
+		for key, value := range vehicle_overrides[vin] {
+			if err := v.apply(key, value); err != nil {
+				fmt.Printf("invalid vehicle setting for %s: %s\n", vin, err)
+				os.Exit(1)
+			}
+		}
+		settings.Vehicles[vin] = v
+	}
 }
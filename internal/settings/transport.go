@@ -0,0 +1,45 @@
+package settings
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// validHeaders returns a validator of `Name: value` header arguments, name is used in errors
+func validHeaders(name string) func(args []string) error {
+	return func(args []string) error {
+		for _, header := range args {
+			if header_name, _, ok := strings.Cut(header, ":"); !ok || strings.TrimSpace(header_name) == "" {
+				return fmt.Errorf("invalid %s (%s)", name, header)
+			}
+		}
+		return nil
+	}
+}
+
+// Headers converts `Name: value` header settings (--mqtt-ws-header, --proxy-header) to HTTP headers
+func Headers(headers []string) http.Header {
+	result := http.Header{}
+	for _, header := range headers {
+		// Already validated when parsing settings
+		name, value, _ := strings.Cut(header, ":")
+		result.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	return result
+}
+
+// LoadCaFile reads a CA bundle (PEM) from --mqtt-tls-ca or --proxy-tls-ca, name is used in errors
+func LoadCaFile(filename string, name string) (*x509.CertPool, error) {
+	ca_pem, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s CA file: %w", name, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca_pem) {
+		return nil, fmt.Errorf("no valid PEM certificates found in %s CA file (%s)", name, filename)
+	}
+	return pool, nil
+}
@@ -0,0 +1,127 @@
+package settings
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/akamensky/argparse"
+)
+
+// Settings that can be overridden per vehicle, with `--vin-option` or in the `vehicles` block of the configuration file
+var vehicleSettingKeys = []string{
+	"name",
+	"proxy_host",
+	"poll_interval",
+	"poll_interval_charging",
+	"poll_interval_disconnected",
+	"fast_poll_time",
+	"max_charging_amps",
+}
+
+// vehicleOverrides are the per vehicle settings by VIN and setting key
+type vehicleOverrides map[string]map[string]string
+
+func (o vehicleOverrides) set(vin string, key string, value string) {
+	if _, ok := o[vin]; !ok {
+		o[vin] = make(map[string]string)
+	}
+	o[vin][key] = value
+}
+
+// setVinOptions sets `--vin-option` values, over the ones from the config file
+func (o vehicleOverrides) setVinOptions(args map[string]argparse.Arg, vins []string, options []string) error {
+	for _, option := range options {
+		vin, key, value, err := parseVinOption(option)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(vins, vin) {
+			return fmt.Errorf("vehicle option for unknown VIN (%s)", vin)
+		}
+		if err := validateVehicleSetting(args, vin, key, value); err != nil {
+			return err
+		}
+		o.set(vin, key, value)
+	}
+	return nil
+}
+
+// validateVehicleSetting validates a per vehicle setting with the validator of the global argument
+func validateVehicleSetting(args map[string]argparse.Arg, vin string, key string, value string) error {
+	if !slices.Contains(vehicleSettingKeys, key) {
+		return fmt.Errorf("unknown vehicle setting `%s` for %s", key, vin)
+	}
+	arg, ok := args[key]
+	if !ok {
+		return nil
+	}
+	if opts := arg.GetOpts(); opts != nil && opts.Validate != nil {
+		if err := opts.Validate([]string{value}); err != nil {
+			return fmt.Errorf("invalid value for `%s` of %s: %w", key, vin, err)
+		}
+	}
+	return nil
+}
+
+// parseVinOption parses a `VIN:key=value` vehicle option
+func parseVinOption(option string) (vin string, key string, value string, err error) {
+	vin, key_value, ok := strings.Cut(option, ":")
+	if !ok {
+		return "", "", "", fmt.Errorf("invalid vehicle option (%s), expected VIN:key=value", option)
+	}
+	key, value, ok = strings.Cut(key_value, "=")
+	if !ok {
+		return "", "", "", fmt.Errorf("invalid vehicle option (%s), expected VIN:key=value", option)
+	}
+	if !slices.Contains(vehicleSettingKeys, key) {
+		return "", "", "", fmt.Errorf("unknown vehicle setting `%s`, expected one of %s", key, strings.Join(vehicleSettingKeys, ", "))
+	}
+	return vin, key, value, nil
+}
+
+// apply sets a per vehicle setting
+func (v *VehicleSettings) apply(key string, value string) error {
+	if key == "name" {
+		v.Name = value
+		return nil
+	} else if key == "proxy_host" {
+		v.ProxyHosts = splitProxyHosts([]string{value})
+		if len(v.ProxyHosts) == 0 {
+			return fmt.Errorf("expected a proxy host for `%s`", key)
+		}
+		return nil
+	}
+
+	value_int, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("expected an integer for `%s`", key)
+	}
+	switch key {
+	case "poll_interval":
+		v.PollInterval = value_int
+	case "poll_interval_charging":
+		v.PollIntervalCharging = value_int
+	case "poll_interval_disconnected":
+		v.PollIntervalDisconnected = value_int
+	case "fast_poll_time":
+		v.FastPollTime = value_int
+	case "max_charging_amps":
+		v.MaxChargingAmps = value_int
+	}
+	return nil
+}
+
+// splitProxyHosts returns the proxy hosts of comma separated values, in order
+func splitProxyHosts(values []string) []string {
+	hosts := []string{}
+	for _, value := range values {
+		for _, host := range strings.Split(value, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,144 @@
+package settings
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/akamensky/argparse"
+)
+
+func TestParseVinOption(t *testing.T) {
+	tests := []struct {
+		option string
+		vin    string
+		key    string
+		value  string
+		err    string
+	}{
+		{option: testVin1 + ":name=My Car", vin: testVin1, key: "name", value: "My Car"},
+		{option: testVin1 + ":proxy_host=http://a:8080,http://b:8080", vin: testVin1, key: "proxy_host", value: "http://a:8080,http://b:8080"},
+		{option: testVin1 + ":poll_interval=", vin: testVin1, key: "poll_interval", value: ""},
+		{option: testVin1 + ":name=a=b", vin: testVin1, key: "name", value: "a=b"},
+		{option: testVin1 + "name=x", err: "expected VIN:key=value"},
+		{option: testVin1 + ":name", err: "expected VIN:key=value"},
+		{option: testVin1 + ":mqtt_pass=x", err: "unknown vehicle setting `mqtt_pass`"},
+	}
+	for _, test := range tests {
+		t.Run(test.option, func(t *testing.T) {
+			vin, key, value, err := parseVinOption(test.option)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if vin != test.vin || key != test.key || value != test.value {
+				t.Errorf("got %s, %s, %s", vin, key, value)
+			}
+		})
+	}
+}
+
+func TestVehicleApply(t *testing.T) {
+	s := &Settings{
+		ProxyHosts:               []string{"http://localhost:8080"},
+		PollInterval:             90,
+		PollIntervalCharging:     20,
+		PollIntervalDisconnected: 10,
+		FastPollTime:             120,
+		MaxChargingAmps:          16,
+	}
+	tests := []struct {
+		key   string
+		value string
+		want  func(v *VehicleSettings)
+		err   string
+	}{
+		{key: "name", value: "My Car", want: func(v *VehicleSettings) { v.Name = "My Car" }},
+		{key: "proxy_host", value: "http://a:8080, http://b:8080", want: func(v *VehicleSettings) { v.ProxyHosts = []string{"http://a:8080", "http://b:8080"} }},
+		{key: "poll_interval", value: "30", want: func(v *VehicleSettings) { v.PollInterval = 30 }},
+		{key: "poll_interval_charging", value: "5", want: func(v *VehicleSettings) { v.PollIntervalCharging = 5 }},
+		{key: "poll_interval_disconnected", value: "60", want: func(v *VehicleSettings) { v.PollIntervalDisconnected = 60 }},
+		{key: "fast_poll_time", value: "0", want: func(v *VehicleSettings) { v.FastPollTime = 0 }},
+		{key: "max_charging_amps", value: "32", want: func(v *VehicleSettings) { v.MaxChargingAmps = 32 }},
+		{key: "proxy_host", value: " , ", err: "expected a proxy host"},
+		{key: "poll_interval", value: "often", err: "expected an integer for `poll_interval`"},
+	}
+	for _, test := range tests {
+		t.Run(test.key+"="+test.value, func(t *testing.T) {
+			v := s.ForVin(testVin1)
+			err := v.apply(test.key, test.value)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := s.ForVin(testVin1)
+			test.want(&want)
+			if !reflect.DeepEqual(v, want) {
+				t.Errorf("got %+v, expected %+v", v, want)
+			}
+		})
+	}
+}
+
+func TestSetVinOptions(t *testing.T) {
+	config := "vehicles:\n  " + testVin1 + ":\n    name: From config\n    poll_interval: 30\n"
+	tests := []struct {
+		name    string
+		options []string
+		want    vehicleOverrides
+		err     string
+	}{
+		{
+			name: "no options",
+			want: vehicleOverrides{testVin1: {"name": "From config", "poll_interval": "30"}},
+		},
+		{
+			name:    "options over config file",
+			options: []string{testVin1 + ":name=From option", testVin2 + ":poll_interval=15"},
+			want:    vehicleOverrides{testVin1: {"name": "From option", "poll_interval": "30"}, testVin2: {"poll_interval": "15"}},
+		},
+		{
+			name:    "last option wins",
+			options: []string{testVin1 + ":name=First", testVin1 + ":name=Second"},
+			want:    vehicleOverrides{testVin1: {"name": "Second", "poll_interval": "30"}},
+		},
+		{name: "unknown vin", options: []string{"5YJ3E1EA1KF000003:name=x"}, err: "vehicle option for unknown VIN"},
+		{name: "invalid option", options: []string{testVin1 + ":name"}, err: "expected VIN:key=value"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := newTestArgs(t, "-v", testVin1, "-v", testVin2)
+			vehicles, err := loadConfigFile(a.parser, writeTestFile(t, "config.yaml", config), map[string]bool{"vin": true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			args := make(map[string]argparse.Arg)
+			for _, arg := range a.parser.GetArgs() {
+				args[configKey(arg)] = arg
+			}
+			err = vehicles.setVinOptions(args, *a.vins, test.options)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(vehicles, test.want) {
+				t.Errorf("got %v, expected %v", vehicles, test.want)
+			}
+		})
+	}
+}
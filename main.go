@@ -1,6 +1,7 @@
 package main
 
 import (
+	"TeslaBle2Mqtt/internal/broker"
 	"TeslaBle2Mqtt/internal/discovery"
 	"TeslaBle2Mqtt/internal/handler"
 	"TeslaBle2Mqtt/internal/settings"
@@ -10,6 +11,7 @@ import (
 	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 
 	"github.com/charmbracelet/lipgloss"
 	"github.com/charmbracelet/log"
@@ -81,6 +83,14 @@ func ansi16Style() *log.Styles {
 }
 
 func main() {
+	// Subcommands have their own arguments
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[1:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		os.Exit(runRender(os.Args[1:]))
+	}
+
 	set := settings.Get()
 	// Set up logging
 	if set.ForceAnsiColor {
@@ -102,28 +112,67 @@ func main() {
 	log.Debug("Running with", "settings", set)
 	mqtt.DEBUG.Println("Mqtt debug enabled")
 
+	if err := broker.Init(); err != nil {
+		log.Fatal("Invalid MQTT broker configuration", "error", err)
+	}
+	if err := handler.InitProxy(); err != nil {
+		log.Fatal("Invalid proxy configuration", "error", err)
+	}
+
 	configUrl := set.ReportedConfigUrl
 	if configUrl == "{proxy-host}/dashboard" {
-		configUrl = set.ProxyHost + "/dashboard"
+		configUrl = strings.TrimSuffix(set.ProxyHosts[0], "/") + "/dashboard"
+	}
+
+	if set.PollPolicy != "" {
+		if err := handler.LoadPollPolicy(set.PollPolicy); err != nil {
+			log.Fatal("Failed to load poll policy", "error", err)
+		}
+	}
+
+	vinReplacements := make(map[string]map[string]string)
+	for _, vin := range set.Vins {
+		v := set.ForVin(vin)
+		vinReplacements[vin] = map[string]string{
+			"max_charging_amps": fmt.Sprintf("%d", v.MaxChargingAmps),
+		}
+		if v.Name != "" {
+			vinReplacements[vin]["vehicle_name"] = v.Name
+		}
 	}
 
-	discoveries, err := discovery.GetDiscovery(set.SensorsYaml, discovery.DiscoverySettings{
+	discoverySettings := discovery.DiscoverySettings{
 		DiscoveryPrefix:  set.DiscoveryPrefix,
 		MqttPrefix:       set.MqttPrefix,
 		Vins:             set.Vins,
 		Version:          set.ReportedVersion,
 		ConfigurationUrl: configUrl,
-		MaxChargingAmps:  fmt.Sprintf("%d", set.MaxChargingAmps),
-	})
+		VinReplacements:  vinReplacements,
+		SensorsOverlays:  set.SensorsOverlays,
+	}
+	discoveries, err := discovery.GetDiscovery(set.SensorsYaml, discoverySettings)
 	if err != nil {
 		log.Fatal("Failed to get discovery", "error", err)
 	}
+	// All handlers share a single MQTT session, its will marks the handler device
+	// (and with it every vehicle device) as unavailable
+	conn, err := broker.NewConnection(set.MqttPrefix, fmt.Sprintf("%s/status", set.MqttPrefix))
+	if err != nil {
+		log.Fatal("Failed to create MQTT connection", "error", err)
+	}
+	if err := conn.Connect(); err != nil {
+		log.Fatal("Failed to connect to MQTT", "error", err)
+	}
+	defer conn.Close()
+
 	wg := sync.WaitGroup{}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	updates := make(map[string]chan discovery.DiscoveryHandler)
 	for _, d := range discoveries {
+		updates[d.Id] = make(chan discovery.DiscoveryHandler, 1)
 		wg.Add(1)
-		go handler.Run(ctx, &wg, &d)
+		go handler.Run(ctx, &wg, conn, &d, updates[d.Id])
 	}
 
 	// Wait for all handlers to finish
@@ -133,19 +182,54 @@ func main() {
 		success <- true
 	}()
 
+	// Reload sensors configuration on hangup signal
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
 	// Wait for interrupt signal
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 
-	select {
-	case <-success:
-	case <-c:
-		log.Info("Received interrupt, shutting down")
-		cancel()
+	for {
 		select {
-		case <-c:
-			log.Fatal("Forced shutdown")
 		case <-success:
+			return
+		case <-hup:
+			log.Info("Received hangup, reloading sensors configuration")
+			reloadDiscovery(set.SensorsYaml, discoverySettings, updates)
+		case <-c:
+			log.Info("Received interrupt, shutting down")
+			cancel()
+			select {
+			case <-c:
+				log.Fatal("Forced shutdown")
+			case <-success:
+			}
+			return
+		}
+	}
+}
+
+// reloadDiscovery parses the sensors configuration again and passes it on to the running handlers,
+// which apply whatever changed. The old configuration is kept if the new one is invalid.
+func reloadDiscovery(filename string, discoverySettings discovery.DiscoverySettings, updates map[string]chan discovery.DiscoveryHandler) {
+	discoveries, err := discovery.GetDiscovery(filename, discoverySettings)
+	if err != nil {
+		log.Error("Failed to reload discovery, keeping previous configuration", "error", err)
+		return
+	}
+	for _, d := range discoveries {
+		ch, ok := updates[d.Id]
+		if !ok {
+			log.Warn("No running handler for reloaded discovery", "handler", d.Id)
+			continue
+		}
+		// A handler that is busy (e.g. running a command) must not block signal handling, an update it
+		// did not pick up yet is replaced by this one. Only this function sends, so the send never blocks.
+		select {
+		case <-ch:
+		default:
 		}
+		ch <- d
 	}
 }
@@ -0,0 +1,267 @@
+package ha_discovery
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Path is a parsed access path. Besides dotted keys it supports
+//
+//	items[0], items[-1]   array index (negative counts from the end)
+//	items[*].value        every element of an array (or every value of an object, in key order)
+//	items[name=foo].value first element whose `name` is `foo`
+//	items[*].count()      number of elements, any() and all() check if any or all elements are true,
+//	                      count(=X), any(=X) and all(=X) compare elements to X instead
+type Path struct {
+	steps []pathStep
+}
+
+type pathStepKind int
+
+const (
+	keyStep pathStepKind = iota
+	indexStep
+	wildcardStep
+	filterStep
+	aggregateStep
+)
+
+type pathStep struct {
+	kind  pathStepKind
+	key   string // key, filter key or aggregate function
+	index int
+	value string // filter or aggregate comparison value
+	equal bool   // aggregate compares to value
+}
+
+var aggregateFuncs = []string{"count", "any", "all"}
+
+// ParsePath parses an access path
+func ParsePath(path string) (Path, error) {
+	var p Path
+	if path == "" {
+		return p, fmt.Errorf("empty access path")
+	}
+	rest := path
+	for rest != "" {
+		// Key up to the next `.` or `[`
+		end := strings.IndexAny(rest, ".[")
+		if end == -1 {
+			end = len(rest)
+		}
+		// Function arguments can contain `.` and `[`
+		if open := strings.Index(rest, "("); open != -1 && open < end {
+			if close := strings.Index(rest, ")"); close != -1 {
+				end = close + 1
+			}
+		}
+		key := rest[:end]
+		rest = rest[end:]
+
+		if name, args, ok := strings.Cut(key, "("); ok && strings.HasSuffix(args, ")") {
+			if !slices.Contains(aggregateFuncs, name) {
+				return p, fmt.Errorf("unknown function `%s` in access path `%s`", name, path)
+			}
+			step := pathStep{kind: aggregateStep, key: name}
+			args = strings.TrimSuffix(args, ")")
+			if args != "" {
+				if !strings.HasPrefix(args, "=") {
+					return p, fmt.Errorf("invalid argument `%s` for %s in access path `%s`, expected =VALUE", args, name, path)
+				}
+				step.equal = true
+				step.value = args[1:]
+			}
+			p.steps = append(p.steps, step)
+			if rest != "" {
+				return p, fmt.Errorf("%s() must be the last part of access path `%s`", name, path)
+			}
+			break
+		} else if key != "" {
+			p.steps = append(p.steps, pathStep{kind: keyStep, key: key})
+		} else if len(p.steps) == 0 || !strings.HasPrefix(rest, "[") {
+			return p, fmt.Errorf("empty key in access path `%s`", path)
+		}
+
+		// Any number of [...] after the key
+		for strings.HasPrefix(rest, "[") {
+			close := strings.Index(rest, "]")
+			if close == -1 {
+				return p, fmt.Errorf("unclosed `[` in access path `%s`", path)
+			}
+			inner := rest[1:close]
+			rest = rest[close+1:]
+			if inner == "*" {
+				p.steps = append(p.steps, pathStep{kind: wildcardStep})
+			} else if filter_key, filter_value, ok := strings.Cut(inner, "="); ok {
+				if filter_key == "" {
+					return p, fmt.Errorf("empty filter key in access path `%s`", path)
+				}
+				p.steps = append(p.steps, pathStep{kind: filterStep, key: filter_key, value: filter_value})
+			} else if index, err := strconv.Atoi(inner); err == nil {
+				p.steps = append(p.steps, pathStep{kind: indexStep, index: index})
+			} else {
+				return p, fmt.Errorf("invalid index `[%s]` in access path `%s`", inner, path)
+			}
+		}
+
+		if strings.HasPrefix(rest, ".") {
+			rest = rest[1:]
+			if rest == "" {
+				return p, fmt.Errorf("access path `%s` ends with `.`", path)
+			}
+		}
+	}
+	return p, nil
+}
+
+// Keys returns the leading plain keys of the path, up to the first index, wildcard, filter or function
+func (p Path) Keys() []string {
+	keys := []string{}
+	for _, step := range p.steps {
+		if step.kind != keyStep {
+			break
+		}
+		keys = append(keys, step.key)
+	}
+	return keys
+}
+
+// Evaluate resolves the path against a state value, ok is false if the path does not exist in it
+func (p Path) Evaluate(state any) (value any, ok bool) {
+	return evaluateSteps(state, p.steps)
+}
+
+// elements returns the elements of an array, or the values of an object in key order
+func elements(value any) ([]any, bool) {
+	switch v := value.(type) {
+	case []any:
+		return v, true
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		values := make([]any, len(keys))
+		for i, key := range keys {
+			values[i] = v[key]
+		}
+		return values, true
+	default:
+		return nil, false
+	}
+}
+
+// valueString formats a scalar for comparisons with filter and aggregate values
+func valueString(value any) string {
+	if value == nil {
+		return "null"
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+func isTrue(value any) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != "" && v != "false" && v != "0"
+	case nil:
+		return false
+	default:
+		return true
+	}
+}
+
+func evaluateSteps(current any, steps []pathStep) (any, bool) {
+	for i, step := range steps {
+		switch step.kind {
+		case keyStep:
+			current_map, ok := current.(map[string]any)
+			if !ok {
+				return nil, false
+			}
+			if current, ok = current_map[step.key]; !ok {
+				return nil, false
+			}
+		case indexStep:
+			list, ok := current.([]any)
+			if !ok {
+				return nil, false
+			}
+			index := step.index
+			if index < 0 {
+				index += len(list)
+			}
+			if index < 0 || index >= len(list) {
+				return nil, false
+			}
+			current = list[index]
+		case filterStep:
+			list, ok := current.([]any)
+			if !ok {
+				return nil, false
+			}
+			found := false
+			for _, el := range list {
+				if el_value, ok := evaluateSteps(el, []pathStep{{kind: keyStep, key: step.key}}); ok && valueString(el_value) == step.value {
+					current = el
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, false
+			}
+		case wildcardStep:
+			list, ok := elements(current)
+			if !ok {
+				return nil, false
+			}
+			// Steps up to an aggregate apply to each element, the aggregate to all of them
+			per_element := steps[i+1:]
+			after := []pathStep{}
+			for j, s := range per_element {
+				if s.kind == aggregateStep {
+					per_element, after = per_element[:j], per_element[j:]
+					break
+				}
+			}
+			results := []any{}
+			for _, el := range list {
+				if r, ok := evaluateSteps(el, per_element); ok {
+					results = append(results, r)
+				}
+			}
+			return evaluateSteps(results, after)
+		case aggregateStep:
+			list, ok := elements(current)
+			if !ok {
+				return nil, false
+			}
+			matches := 0
+			for _, el := range list {
+				if (step.equal && valueString(el) == step.value) || (!step.equal && isTrue(el)) {
+					matches++
+				}
+			}
+			switch step.key {
+			case "count":
+				if step.equal {
+					return matches, true
+				}
+				return len(list), true
+			case "any":
+				return matches > 0, true
+			case "all":
+				return matches == len(list), true
+			}
+		}
+	}
+	return current, true
+}
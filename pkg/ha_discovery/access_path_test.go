@@ -0,0 +1,122 @@
+package ha_discovery
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// testState is decoded from JSON, so numbers are float64 like in proxy responses
+func testState(t *testing.T) map[string]any {
+	var state map[string]any
+	err := json.Unmarshal([]byte(`{
+		"charge_state": {"battery_level": 80, "charging_state": "Charging"},
+		"tpms": [2.9, 3.0, 3.1, 2.8],
+		"doors": {"df": true, "dr": false, "pf": false, "pr": false},
+		"seats": [
+			{"name": "driver", "heater": 3, "occupied": true},
+			{"name": "passenger", "heater": 0, "occupied": false},
+			{"name": "rear", "heater": 0, "occupied": null}
+		],
+		"empty": []
+	}`), &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestPathEvaluate(t *testing.T) {
+	state := testState(t)
+	tests := []struct {
+		path  string
+		value any
+		ok    bool
+	}{
+		{"charge_state.battery_level", 80.0, true},
+		{"charge_state.charging_state", "Charging", true},
+		{"charge_state.missing", nil, false},
+		{"charge_state.battery_level.nested", nil, false},
+		{"tpms[0]", 2.9, true},
+		{"tpms[3]", 2.8, true},
+		{"tpms[4]", nil, false},
+		{"tpms[-1]", 2.8, true},
+		{"tpms[-4]", 2.9, true},
+		{"tpms[-5]", nil, false},
+		{"charge_state[0]", nil, false},
+		{"seats[name=passenger].heater", 0.0, true},
+		{"seats[name=driver].occupied", true, true},
+		{"seats[occupied=null].name", "rear", true},
+		{"seats[name=nobody].heater", nil, false},
+		{"seats[*].heater", []any{3.0, 0.0, 0.0}, true},
+		{"seats[*].name", []any{"driver", "passenger", "rear"}, true},
+		{"doors[*]", []any{true, false, false, false}, true},
+		{"seats[*].missing", []any{}, true},
+		{"tpms[*].count()", 4, true},
+		{"seats[*].heater.count(=0)", 2, true},
+		{"seats[*].occupied.any()", true, true},
+		{"seats[*].occupied.all()", false, true},
+		{"doors[*].any()", true, true},
+		{"doors.all(=false)", false, true},
+		{"doors.count(=false)", 3, true},
+		{"empty.count()", 0, true},
+		{"empty.any()", false, true},
+		{"empty.all()", true, true},
+		{"charge_state.battery_level.count()", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			p, err := ParsePath(test.path)
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			value, ok := p.Evaluate(state)
+			if ok != test.ok || !reflect.DeepEqual(value, test.value) {
+				t.Errorf("got %#v, %v, expected %#v, %v", value, ok, test.value, test.ok)
+			}
+		})
+	}
+}
+
+func TestParsePathErrors(t *testing.T) {
+	tests := []string{
+		"",
+		".a",
+		"a..b",
+		"a.",
+		"a[0",
+		"a[x]",
+		"a[=x]",
+		"a.sum()",
+		"a.count(x)",
+		"a.count().b",
+	}
+	for _, path := range tests {
+		t.Run(path, func(t *testing.T) {
+			if _, err := ParsePath(path); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestPathKeys(t *testing.T) {
+	tests := []struct {
+		path string
+		keys []string
+	}{
+		{"vehicle_data.charge_state.battery_level", []string{"vehicle_data", "charge_state", "battery_level"}},
+		{"vehicle_data.tpms[0].pressure", []string{"vehicle_data", "tpms"}},
+		{"seats[*].count()", []string{"seats"}},
+	}
+	for _, test := range tests {
+		p, err := ParsePath(test.path)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", test.path, err)
+		}
+		if keys := p.Keys(); !slices.Equal(keys, test.keys) {
+			t.Errorf("%s: got %v, expected %v", test.path, keys, test.keys)
+		}
+	}
+}
@@ -25,7 +25,9 @@ func configureDevice(x any, formatString func(string) any, pub_topic *DevicePubl
 				// 	__get_state: access_path -> state_topic: access_path
 				// 	__get_state/topic_key: access_path -> {topic_key}_state_topic: access_path
 				//  __get_state/!topic_key: access_path -> topic_key: access_path
-				if strings.HasPrefix(key, "__get_state") {
+				// 	__get_state/key_topic: access_path -> key_topic: access_path (e.g. json_attributes_topic)
+				// 	__template, __template/topic_key, __template/!topic_key: same, with a template instead of access path
+				if strings.HasPrefix(key, "__get_state") || strings.HasPrefix(key, "__template") {
 					val_s, ok := val.(string)
 					if !ok {
 						return nil, fmt.Errorf("invalid value for key `%s`", key)
@@ -34,6 +36,16 @@ func configureDevice(x any, formatString func(string) any, pub_topic *DevicePubl
 					if !ok {
 						return nil, fmt.Errorf("expected `%s` to be a string", val_s)
 					}
+					// Access path can be followed by transforms: access_path | round(1) | map(A:ON,B:OFF)
+					binding, err := ParseStateBinding(val_s)
+					if err != nil {
+						return nil, fmt.Errorf("invalid value for key `%s`: %w", key, err)
+					}
+					if is_template := strings.HasPrefix(key, "__template"); is_template && binding.Template == nil {
+						return nil, fmt.Errorf("expected a template for key `%s`, starting with `{{`", key)
+					} else if !is_template && binding.Template != nil {
+						return nil, fmt.Errorf("use __template instead of `%s` for templates", key)
+					}
 					key_parts := strings.SplitN(key, "/", 2)
 					state_topic_key := "state_topic"
 					topic_is_key := false
@@ -41,6 +53,8 @@ func configureDevice(x any, formatString func(string) any, pub_topic *DevicePubl
 						if strings.HasPrefix(key_parts[1], "!") {
 							state_topic_key = key_parts[1][1:]
 							topic_is_key = true
+						} else if strings.HasSuffix(key_parts[1], "_topic") {
+							state_topic_key = key_parts[1]
 						} else {
 							state_topic_key = key_parts[1] + "_state_topic"
 						}
@@ -174,9 +188,43 @@ func GenerateResetConfiguration(original *json.RawMessage) (json.RawMessage, err
 	return json.RawMessage(reset_json), nil
 }
 
+// GenerateUpdateConfiguration returns the updated device configuration with every component that was removed
+// since the original configuration reduced to its platform, so Home Assistant deletes it.
+func GenerateUpdateConfiguration(original *json.RawMessage, updated *json.RawMessage) (json.RawMessage, error) {
+	reset_json, err := GenerateResetConfiguration(original)
+	if err != nil {
+		return nil, err
+	}
+	var reset map[string]any
+	if err := json.Unmarshal(reset_json, &reset); err != nil {
+		return nil, err
+	}
+	var dev map[string]any
+	if err := json.Unmarshal(*updated, &dev); err != nil {
+		return nil, err
+	}
+
+	components, ok := dev["components"].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("components not found in device configuration")
+	}
+	for key, val := range reset["components"].(map[string]any) {
+		if _, ok := components[key]; !ok {
+			components[key] = val
+		}
+	}
+
+	update_json, err := json.Marshal(dev)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.RawMessage(update_json), nil
+}
+
 // ParseDeviceConfiguration parses a device configuration and returns the discovery configuration, publish bindings, and subscribe bindings.
 // It replaces any string in the configuration with `key` with the values in the replacements map and
-// deletes any key that starts with __. It returns bindings for objects with the __get_state or __command key.
+// deletes any key that starts with __. It returns bindings for objects with the __get_state, __template or __command key.
 func ParseDeviceConfiguration(dev map[string]any, replacements map[string]string) (discovery any, pub_topic DevicePublishBindings, sub_topic DeviceSubscribeBindings, err error) {
 	if _, ok := replacements["int"]; ok {
 		return nil, nil, nil, fmt.Errorf("int is a reserved replacement key")
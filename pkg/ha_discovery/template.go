@@ -0,0 +1,130 @@
+package ha_discovery
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// toFloat converts a state value (JSON number, bool or numeric string) to a float
+func toFloat(value any) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	case nil:
+		return 0, fmt.Errorf("missing value")
+	default:
+		return 0, fmt.Errorf("expected a number, got %T", value)
+	}
+}
+
+func numericFunc(op func(a float64, b float64) float64) func(any, any) (float64, error) {
+	return func(a any, b any) (float64, error) {
+		a_f, err := toFloat(a)
+		if err != nil {
+			return 0, err
+		}
+		b_f, err := toFloat(b)
+		if err != nil {
+			return 0, err
+		}
+		return op(a_f, b_f), nil
+	}
+}
+
+// Helper functions available in __template
+var templateFuncs = template.FuncMap{
+	// Value at a dotted access path, nil if it does not exist: {{ get . "vehicle_data.charge_state.battery_level" }}
+	"get": func(state map[string]any, path string) (any, error) {
+		p, err := ParsePath(path)
+		if err != nil {
+			return nil, err
+		}
+		value, _ := p.Evaluate(state)
+		return value, nil
+	},
+	"float": toFloat,
+	"add":   numericFunc(func(a float64, b float64) float64 { return a + b }),
+	"sub":   numericFunc(func(a float64, b float64) float64 { return a - b }),
+	"mul":   numericFunc(func(a float64, b float64) float64 { return a * b }),
+	"div": func(a any, b any) (float64, error) {
+		b_f, err := toFloat(b)
+		if err != nil {
+			return 0, err
+		}
+		if b_f == 0 {
+			return 0, fmt.Errorf("div by zero")
+		}
+		return numericFunc(func(a float64, b float64) float64 { return a / b })(a, b)
+	},
+	// Rounds to the given number of digits: {{ round 1 .x }}
+	"round": func(digits int, value any) (string, error) {
+		value_f, err := toFloat(value)
+		if err != nil {
+			return "", err
+		}
+		scale := math.Pow(10, float64(digits))
+		return strconv.FormatFloat(math.Round(value_f*scale)/scale, 'f', digits, 64), nil
+	},
+	"default": func(def any, value any) any {
+		if value == nil || value == "" {
+			return def
+		}
+		return value
+	},
+	"now": time.Now,
+	// Time the given minutes from t: {{ now | addMinutes .minutes_to_full_charge }}
+	"addMinutes": func(minutes any, t time.Time) (time.Time, error) {
+		minutes_f, err := toFloat(minutes)
+		if err != nil {
+			return t, err
+		}
+		return t.Add(time.Duration(minutes_f * float64(time.Minute))), nil
+	},
+	// Rounds a time down to a multiple of duration, so it does not change on every poll: {{ now | truncate "1m" }}
+	"truncate": func(duration string, t time.Time) (time.Time, error) {
+		d, err := time.ParseDuration(duration)
+		if err != nil {
+			return t, err
+		}
+		return t.Truncate(d), nil
+	},
+	"rfc3339": func(t time.Time) string {
+		return t.Format(time.RFC3339)
+	},
+}
+
+func parseTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("__template").Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// Execute evaluates a template binding against the full state. Templates that fail, for
+// example because the vehicle is asleep and its data is missing, evaluate to "None".
+func (b *StateBinding) Execute(state map[string]any) string {
+	var out bytes.Buffer
+	if err := b.Template.Execute(&out, state); err != nil {
+		return "None"
+	}
+	value := strings.TrimSpace(out.String())
+	if value == "" || value == "<no value>" {
+		return "None"
+	}
+	return value
+}
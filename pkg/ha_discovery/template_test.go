@@ -0,0 +1,64 @@
+package ha_discovery
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTemplates(t *testing.T) {
+	state := testState(t)
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{`{{ .charge_state.charging_state }}`, "Charging"},
+		{`{{ get . "charge_state.battery_level" }}`, "80"},
+		{`{{ get . "seats[name=driver].heater" }}`, "3"},
+		{`{{ get . "seats[*].occupied.any()" }}`, "true"},
+		{`{{ add .charge_state.battery_level 5 }}`, "85"},
+		{`{{ sub .charge_state.battery_level "30" }}`, "50"},
+		{`{{ mul .charge_state.battery_level 0.5 }}`, "40"},
+		{`{{ div .charge_state.battery_level 8 }}`, "10"},
+		{`{{ float "2.5" }}`, "2.5"},
+		{`{{ round 1 (div .charge_state.battery_level 3) }}`, "26.7"},
+		{`{{ round 0 (get . "tpms[-1]") }}`, "3"},
+		{`{{ default "n/a" .missing }}`, "n/a"},
+		{`{{ default "n/a" .charge_state.charging_state }}`, "Charging"},
+		{`{{ if get . "doors.any()" }}open{{ else }}closed{{ end }}`, "open"},
+		{`{{ .missing }}`, "None"},
+		{`  `, "None"},
+		// Failed templates are published as None
+		{`{{ div .charge_state.battery_level 0 }}`, "None"},
+		{`{{ add .missing 1 }}`, "None"},
+		{`{{ add .charge_state.charging_state 1 }}`, "None"},
+		{`{{ get . "a..b" }}`, "None"},
+		{`{{ now | truncate "x" }}`, "None"},
+	}
+	for _, test := range tests {
+		t.Run(test.template, func(t *testing.T) {
+			tmpl, err := parseTemplate(test.template)
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			b := StateBinding{Template: tmpl}
+			if got := b.Execute(state); got != test.want {
+				t.Errorf("got %q, expected %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTemplateTime(t *testing.T) {
+	b, err := ParseStateBinding(`{{ now | addMinutes .minutes | truncate "1h" | rfc3339 }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := time.Parse(time.RFC3339, b.Execute(map[string]any{"minutes": 120.0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Now().Add(2 * time.Hour).Truncate(time.Hour)
+	if diff := got.Sub(want); diff < -time.Hour || diff > time.Hour || got.Minute() != 0 || got.Second() != 0 {
+		t.Errorf("got %s, expected about %s", got, want)
+	}
+}
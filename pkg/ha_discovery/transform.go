@@ -0,0 +1,199 @@
+package ha_discovery
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Transform is a single step of a __get_state pipeline, it converts a state value before publishing
+type Transform struct {
+	Name  string
+	Args  []string
+	apply func(value string) (string, error)
+}
+
+// StateBinding is a parsed __get_state value: `access.path | transform(args) | ...`,
+// or a parsed __template value: `{{ template }}`
+type StateBinding struct {
+	Path       AccessPath
+	Transforms []Transform
+	Template   *template.Template
+	path       Path
+}
+
+var transformPattern = regexp.MustCompile(`^([a-z_]+)(?:\((.*)\))?$`)
+
+// isEmptyValue reports values published for missing state, numeric transforms leave them as they are
+func isEmptyValue(value string) bool {
+	return value == "None" || value == "null"
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// numericTransform builds a transform that applies op to a number, with a single number argument
+func numericTransform(name string, args []string, op func(value float64, arg float64) float64) (func(string) (string, error), error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("%s expects one argument", name)
+	}
+	arg, err := strconv.ParseFloat(args[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s expects a number, got `%s`", name, args[0])
+	}
+	return func(value string) (string, error) {
+		if isEmptyValue(value) {
+			return value, nil
+		}
+		value_f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", fmt.Errorf("%s expects a number, got `%s`", name, value)
+		}
+		return formatFloat(op(value_f, arg)), nil
+	}, nil
+}
+
+func parseTransform(step string) (Transform, error) {
+	match := transformPattern.FindStringSubmatch(step)
+	if match == nil {
+		return Transform{}, fmt.Errorf("invalid transform `%s`", step)
+	}
+	t := Transform{Name: match[1]}
+	if match[2] != "" {
+		for _, arg := range strings.Split(match[2], ",") {
+			t.Args = append(t.Args, strings.TrimSpace(arg))
+		}
+	}
+
+	var err error
+	switch t.Name {
+	case "round":
+		digits := 0
+		if len(t.Args) > 1 {
+			return t, fmt.Errorf("round expects at most one argument")
+		} else if len(t.Args) == 1 {
+			digits, err = strconv.Atoi(t.Args[0])
+			if err != nil || digits < 0 {
+				return t, fmt.Errorf("round expects a number of digits, got `%s`", t.Args[0])
+			}
+		}
+		t.apply = func(value string) (string, error) {
+			if isEmptyValue(value) {
+				return value, nil
+			}
+			value_f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return "", fmt.Errorf("round expects a number, got `%s`", value)
+			}
+			scale := math.Pow(10, float64(digits))
+			return strconv.FormatFloat(math.Round(value_f*scale)/scale, 'f', digits, 64), nil
+		}
+	case "mul":
+		t.apply, err = numericTransform(t.Name, t.Args, func(value float64, arg float64) float64 { return value * arg })
+	case "div":
+		t.apply, err = numericTransform(t.Name, t.Args, func(value float64, arg float64) float64 { return value / arg })
+		if err == nil {
+			// Already parsed by numericTransform, this also catches `0.0` and `-0`
+			if arg, _ := strconv.ParseFloat(t.Args[0], 64); arg == 0 {
+				err = fmt.Errorf("div by zero")
+			}
+		}
+	case "add":
+		t.apply, err = numericTransform(t.Name, t.Args, func(value float64, arg float64) float64 { return value + arg })
+	case "map":
+		// map(FROM:TO,...), `*` matches every value that is not listed
+		mapping := make(map[string]string)
+		for _, arg := range t.Args {
+			from, to, ok := strings.Cut(arg, ":")
+			if !ok {
+				return t, fmt.Errorf("map expects FROM:TO arguments, got `%s`", arg)
+			}
+			mapping[from] = to
+		}
+		if len(mapping) == 0 {
+			return t, fmt.Errorf("map expects at least one argument")
+		}
+		t.apply = func(value string) (string, error) {
+			if to, ok := mapping[value]; ok {
+				return to, nil
+			}
+			if to, ok := mapping["*"]; ok {
+				return to, nil
+			}
+			return value, nil
+		}
+	case "default":
+		if len(t.Args) != 1 {
+			return t, fmt.Errorf("default expects one argument")
+		}
+		t.apply = func(value string) (string, error) {
+			if isEmptyValue(value) {
+				return t.Args[0], nil
+			}
+			return value, nil
+		}
+	case "upper", "lower":
+		if len(t.Args) != 0 {
+			return t, fmt.Errorf("%s expects no arguments", t.Name)
+		}
+		t.apply = func(value string) (string, error) {
+			if t.Name == "upper" {
+				return strings.ToUpper(value), nil
+			}
+			return strings.ToLower(value), nil
+		}
+	default:
+		return t, fmt.Errorf("unknown transform `%s`", t.Name)
+	}
+	return t, err
+}
+
+// ParseStateBinding parses a __get_state value into its access path and transforms, or a
+// __template value (starting with `{{`) into its template
+func ParseStateBinding(binding string) (StateBinding, error) {
+	if strings.HasPrefix(strings.TrimSpace(binding), "{{") {
+		tmpl, err := parseTemplate(binding)
+		if err != nil {
+			return StateBinding{}, err
+		}
+		return StateBinding{Template: tmpl}, nil
+	}
+	steps := strings.Split(binding, "|")
+	b := StateBinding{Path: strings.TrimSpace(steps[0])}
+	if b.Path == "" {
+		return b, fmt.Errorf("missing access path in `%s`", binding)
+	}
+	var err error
+	if b.path, err = ParsePath(b.Path); err != nil {
+		return b, err
+	}
+	for _, step := range steps[1:] {
+		t, err := parseTransform(strings.TrimSpace(step))
+		if err != nil {
+			return b, err
+		}
+		b.Transforms = append(b.Transforms, t)
+	}
+	return b, nil
+}
+
+// Lookup resolves the access path of the binding against the state
+func (b *StateBinding) Lookup(state map[string]any) (any, bool) {
+	return b.path.Evaluate(state)
+}
+
+// Apply runs the value through every transform of the binding
+func (b *StateBinding) Apply(value string) (string, error) {
+	for _, t := range b.Transforms {
+		var err error
+		value, err = t.apply(value)
+		if err != nil {
+			return "", err
+		}
+	}
+	return value, nil
+}
@@ -0,0 +1,109 @@
+package ha_discovery
+
+import "testing"
+
+func TestTransforms(t *testing.T) {
+	tests := []struct {
+		binding string
+		value   string
+		want    string
+	}{
+		{"a | round", "21.5", "22"},
+		{"a | round(1)", "21.46", "21.5"},
+		{"a | round(2)", "3", "3.00"},
+		{"a | round(1)", "None", "None"},
+		{"a | mul(1.609)", "10", "16.09"},
+		{"a | mul(2)", "null", "null"},
+		{"a | div(10)", "215", "21.5"},
+		{"a | div(-2)", "3", "-1.5"},
+		{"a | add(-273.15)", "293.15", "20"},
+		{"a | map(true:ON,false:OFF)", "true", "ON"},
+		{"a | map(true:ON,false:OFF)", "other", "other"},
+		{"a | map(Charging:ON,*:OFF)", "Stopped", "OFF"},
+		{"a | default(unknown)", "None", "unknown"},
+		{"a | default(unknown)", "null", "unknown"},
+		{"a | default(unknown)", "x", "x"},
+		{"a | upper", "Charging", "CHARGING"},
+		{"a | lower", "Charging", "charging"},
+		{"a | mul(100) | round | map(100:full)", "0.999", "full"},
+		{"a", "unchanged", "unchanged"},
+	}
+	for _, test := range tests {
+		t.Run(test.binding+"/"+test.value, func(t *testing.T) {
+			b, err := ParseStateBinding(test.binding)
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			got, err := b.Apply(test.value)
+			if err != nil {
+				t.Fatalf("failed to apply: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("got %q, expected %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTransformErrors(t *testing.T) {
+	tests := []struct {
+		binding string
+		value   string
+	}{
+		{"a | round", "x"},
+		{"a | mul(2)", "x"},
+		{"a | add(1)", "true"},
+	}
+	for _, test := range tests {
+		t.Run(test.binding+"/"+test.value, func(t *testing.T) {
+			b, err := ParseStateBinding(test.binding)
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			if _, err := b.Apply(test.value); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestParseStateBindingErrors(t *testing.T) {
+	tests := []string{
+		"",
+		" | round",
+		"a[",
+		"a | unknown",
+		"a | round(-1)",
+		"a | round(1,2)",
+		"a | round(x)",
+		"a | mul",
+		"a | mul(x)",
+		"a | div(0)",
+		"a | div(0.0)",
+		"a | div( 0 )",
+		"a | div(-0)",
+		"a | map",
+		"a | map(x)",
+		"a | default",
+		"a | upper(x)",
+		"a | Round",
+		"{{ .a",
+	}
+	for _, binding := range tests {
+		t.Run(binding, func(t *testing.T) {
+			if _, err := ParseStateBinding(binding); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestParseStateBindingPath(t *testing.T) {
+	b, err := ParseStateBinding(" vehicle_data.charge_state.battery_level | round ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Path != "vehicle_data.charge_state.battery_level" || len(b.Transforms) != 1 || b.Template != nil {
+		t.Errorf("unexpected binding %+v", b)
+	}
+}
@@ -0,0 +1,89 @@
+package proxyclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// circuitBreaker stops requests to a proxy after threshold failed requests in a row, until a
+// single request after cooldown succeeds again
+type circuitBreaker struct {
+	lock      sync.Mutex
+	host      string
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	opened    time.Time
+	probing   bool
+}
+
+// allow returns ErrCircuitOpen if a request should not be sent
+func (b *circuitBreaker) allow() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.threshold == 0 {
+		return nil
+	}
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.opened) < b.cooldown {
+			return ErrCircuitOpen
+		}
+		log.Debug("Probing proxy", "host", b.host)
+		b.state = BreakerHalfOpen
+		b.probing = true
+	case BreakerHalfOpen:
+		// Only one request checks if the proxy is back
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// record counts the result of a request, failed is set if the proxy could not be reached or its adapter failed
+func (b *circuitBreaker) record(failed bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.probing = false
+	if !failed {
+		if b.state != BreakerClosed {
+			log.Info("Proxy is back, closing circuit breaker", "host", b.host)
+		}
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.threshold > 0 && (b.state == BreakerHalfOpen || b.failures >= b.threshold) {
+		if b.state != BreakerOpen {
+			log.Warn("Proxy keeps failing, opening circuit breaker", "host", b.host, "failures", b.failures)
+		}
+		b.state = BreakerOpen
+		b.opened = time.Now()
+	}
+}
+
+// cancel releases the probe of a request that was cancelled before its result was known, so the
+// next request checks if the proxy is back
+func (b *circuitBreaker) cancel() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.probing = false
+}
+
+// Status is the circuit breaker state of a client
+type Status struct {
+	CircuitBreaker      string `json:"circuit_breaker"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+}
@@ -0,0 +1,86 @@
+package proxyclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testProxy answers connection_status requests depending on its mode
+func testProxy(t *testing.T, mode *atomic.Value) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch mode.Load() {
+		case "fail":
+			// Drops the connection, the client sees an unreachable proxy
+			panic(http.ErrAbortHandler)
+		case "hang":
+			<-r.Context().Done()
+		default:
+			w.Write([]byte(`{"response":{"result":true,"reason":"","response":{"address":"AA:BB","rssi":-60}}}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestBreakerCancelledProbe(t *testing.T) {
+	var mode atomic.Value
+	mode.Store("fail")
+	server := testProxy(t, &mode)
+	client := New(server.URL, Options{BreakerThreshold: 1, BreakerCooldown: 10 * time.Millisecond})
+
+	if _, err := client.ConnectionStatus(context.Background(), "VIN"); err == nil {
+		t.Fatal("expected an error from a failing proxy")
+	}
+	if status := client.Status(); status.CircuitBreaker != BreakerOpen {
+		t.Fatalf("expected an open breaker, got %+v", status)
+	}
+
+	// The probe is cancelled before the proxy answers
+	time.Sleep(20 * time.Millisecond)
+	mode.Store("hang")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := client.ConnectionStatus(ctx, "VIN"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a cancelled probe, got %v", err)
+	}
+
+	// The next request probes the proxy again and closes the breaker
+	mode.Store("ok")
+	status, err := client.ConnectionStatus(context.Background(), "VIN")
+	if err != nil {
+		t.Fatalf("expected the proxy to be probed again, got %v", err)
+	}
+	if !status.InRange() {
+		t.Fatalf("expected the vehicle in range, got %+v", status)
+	}
+	if status := client.Status(); status.CircuitBreaker != BreakerClosed {
+		t.Fatalf("expected a closed breaker, got %+v", status)
+	}
+}
+
+func TestBreakerCancelledBackoff(t *testing.T) {
+	var mode atomic.Value
+	mode.Store("fail")
+	server := testProxy(t, &mode)
+	client := New(server.URL, Options{BreakerThreshold: 1, BreakerCooldown: 10 * time.Millisecond, Retries: 1, RetryBackoff: time.Second})
+
+	client.ConnectionStatus(context.Background(), "VIN")
+	time.Sleep(20 * time.Millisecond)
+
+	// The probe fails and is cancelled while waiting for the retry
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := client.ConnectionStatus(ctx, "VIN"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a cancelled probe, got %v", err)
+	}
+
+	mode.Store("ok")
+	if _, err := client.ConnectionStatus(context.Background(), "VIN"); err != nil {
+		t.Fatalf("expected the proxy to be probed again, got %v", err)
+	}
+}
@@ -0,0 +1,266 @@
+// Package proxyclient is a client for the TeslaBleHttpProxy API, with typed responses, retries of
+// failed status requests and a circuit breaker
+package proxyclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Options of a client, the zero value sends every request once without a timeout
+type Options struct {
+	// Timeout of a single status request, 0 to only use the context
+	StatusTimeout time.Duration
+	// Timeout of a command, which waits until the vehicle has executed it (and is woken up for it)
+	CommandTimeout time.Duration
+	// Number of retries of a failed status request
+	Retries int
+	// Wait before the first retry, doubled with every retry
+	RetryBackoff time.Duration
+	// Failed requests in a row after which the proxy is not polled until BreakerCooldown passes, 0 disables it
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	// Extra headers sent with every request
+	Headers http.Header
+	// Authorization sent with every request, a bearer token or basic auth if Username is set
+	BearerToken string
+	Username    string
+	Password    string
+	// HTTP client used for requests, http.DefaultClient if nil
+	HttpClient *http.Client
+}
+
+// Client sends requests to a TeslaBleHttpProxy, it is safe for concurrent use
+type Client struct {
+	host        string
+	options     Options
+	http_client *http.Client
+	breaker     *circuitBreaker
+}
+
+// New returns a client for the proxy at host, e.g. `http://localhost:8080`. The host can include
+// a base path (e.g. `https://example.com/tesla`) if the proxy is behind a reverse proxy.
+func New(host string, options Options) *Client {
+	host = strings.TrimSuffix(host, "/")
+	http_client := options.HttpClient
+	if http_client == nil {
+		http_client = http.DefaultClient
+	}
+	return &Client{
+		host:        host,
+		options:     options,
+		http_client: http_client,
+		breaker: &circuitBreaker{
+			host:      host,
+			threshold: options.BreakerThreshold,
+			cooldown:  options.BreakerCooldown,
+			state:     BreakerClosed,
+		},
+	}
+}
+
+// Host returns the proxy host
+func (c *Client) Host() string {
+	return c.host
+}
+
+// Status returns the circuit breaker state
+func (c *Client) Status() Status {
+	c.breaker.lock.Lock()
+	defer c.breaker.lock.Unlock()
+	return Status{
+		CircuitBreaker:      c.breaker.state,
+		ConsecutiveFailures: c.breaker.failures,
+	}
+}
+
+// ConnectionStatus returns the BLE connection status of a vehicle
+func (c *Client) ConnectionStatus(ctx context.Context, vin string) (*ConnectionStatus, error) {
+	response, err := c.Get(ctx, fmt.Sprintf("/api/proxy/1/vehicles/%s/connection_status", url.PathEscape(vin)))
+	if err != nil {
+		return nil, err
+	}
+	status := &ConnectionStatus{raw: raw{response}}
+	if err := decode(response, status); err != nil {
+		return nil, fmt.Errorf("failed to decode connection status: %w", err)
+	}
+	return status, nil
+}
+
+// BodyControllerState returns the body controller state, which does not wake the vehicle
+func (c *Client) BodyControllerState(ctx context.Context, vin string) (*BodyControllerState, error) {
+	response, err := c.Get(ctx, fmt.Sprintf("/api/proxy/1/vehicles/%s/body_controller_state", url.PathEscape(vin)))
+	if err != nil {
+		return nil, err
+	}
+	state := &BodyControllerState{raw: raw{response}}
+	if err := decode(response, state); err != nil {
+		return nil, fmt.Errorf("failed to decode body controller state: %w", err)
+	}
+	return state, nil
+}
+
+// VehicleData returns the requested vehicle_data endpoints (e.g. charge_state, climate_state),
+// the vehicle has to be awake
+func (c *Client) VehicleData(ctx context.Context, vin string, endpoints []string) (*VehicleData, error) {
+	endpoint := fmt.Sprintf("/api/1/vehicles/%s/vehicle_data", url.PathEscape(vin))
+	if len(endpoints) > 0 {
+		endpoint += "?endpoints=" + strings.Join(endpoints, ";")
+	}
+	response, err := c.Get(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	data := &VehicleData{raw: raw{response}}
+	if err := decode(response, data); err != nil {
+		return nil, fmt.Errorf("failed to decode vehicle data: %w", err)
+	}
+	return data, nil
+}
+
+// backoff returns the wait before a retry, doubling with each attempt with up to 50% jitter
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.options.RetryBackoff << attempt
+	return d/2 + rand.N(d/2+1)
+}
+
+// Get requests a status endpoint and returns the raw response, retrying it if it fails with a
+// retryable error
+func (c *Client) Get(ctx context.Context, endpoint string) (map[string]any, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	response, err := c.getWithRetries(ctx, endpoint)
+	if ctx.Err() != nil {
+		c.breaker.cancel()
+	} else {
+		c.breaker.record(isProxyFailure(err))
+	}
+	return response, err
+}
+
+func (c *Client) getWithRetries(ctx context.Context, endpoint string) (map[string]any, error) {
+	for attempt := 0; ; attempt++ {
+		response, err := c.request(ctx, http.MethodGet, endpoint, "", c.options.StatusTimeout)
+		if err == nil || !IsRetryable(err) || attempt >= c.options.Retries || ctx.Err() != nil {
+			return response, err
+		}
+		wait := c.backoff(attempt)
+		log.Debug("Retrying proxy request", "endpoint", endpoint, "attempt", attempt+1, "wait", wait, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Post sends a command. Commands are not retried, as some of them toggle (e.g. actuate_trunk)
+// and might have been executed even if the response was lost. They are also sent while the
+// circuit breaker is open, and close it if they succeed.
+func (c *Client) Post(ctx context.Context, endpoint string, body string) (map[string]any, error) {
+	response, err := c.request(ctx, http.MethodPost, endpoint, body, c.options.CommandTimeout)
+	if ctx.Err() == nil {
+		c.breaker.record(isProxyFailure(err))
+	}
+	return response, err
+}
+
+// Version returns the version of the proxy. The request is sent once and bypasses the circuit
+// breaker, so it can be used as a health check.
+func (c *Client) Version(ctx context.Context) (string, error) {
+	result, err := c.send(ctx, http.MethodGet, "/api/proxy/1/version", "", c.options.StatusTimeout)
+	if err != nil {
+		return "", err
+	}
+	if version, ok := result["version"].(string); ok {
+		return version, nil
+	}
+	// Wrapped like the other endpoints
+	response, _ := result["response"].(map[string]any)
+	response_response, _ := response["response"].(map[string]any)
+	if version, ok := response_response["version"].(string); ok {
+		return version, nil
+	}
+	return "", fmt.Errorf("no version in response")
+}
+
+// request sends a single request to the proxy and returns the inner response
+func (c *Client) request(ctx context.Context, method string, endpoint string, body string, timeout time.Duration) (map[string]any, error) {
+	result, err := c.send(ctx, method, endpoint, body, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	response, ok := result["response"].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("no response in result")
+	}
+
+	response_result, ok := response["result"].(bool)
+	if !ok {
+		return nil, fmt.Errorf("no result in response")
+	}
+
+	if !response_result {
+		reason, _ := response["reason"].(string)
+		return nil, &Error{Reason: reason}
+	}
+
+	if response_response, ok := response["response"].(map[string]any); ok {
+		return response_response, nil
+	}
+
+	return nil, nil
+}
+
+// send sends a single request to the proxy and returns the decoded JSON body
+func (c *Client) send(ctx context.Context, method string, endpoint string, body string, timeout time.Duration) (map[string]any, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	proxy_url := fmt.Sprintf("%s%s", c.host, endpoint)
+	log.Debug("Getting proxy response", "url", proxy_url)
+	var reader io.Reader = nil
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, proxy_url, reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	for name, values := range c.options.Headers {
+		request.Header[name] = values
+	}
+	if c.options.BearerToken != "" {
+		request.Header.Set("Authorization", "Bearer "+c.options.BearerToken)
+	} else if c.options.Username != "" {
+		request.SetBasicAuth(c.options.Username, c.options.Password)
+	}
+	resp, err := c.http_client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, fmt.Errorf("%w (%s)", ErrUnauthorized, resp.Status)
+	}
+
+	var result map[string]any
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,100 @@
+package proxyclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// Command sends a vehicle command (e.g. `door_lock`) with an optional JSON body, and waits until
+// the vehicle has executed it
+func (c *Client) Command(ctx context.Context, vin string, command string, body string) error {
+	endpoint := fmt.Sprintf("/api/1/vehicles/%s/command/%s?wait=true", url.PathEscape(vin), url.PathEscape(command))
+	_, err := c.Post(ctx, endpoint, body)
+	return err
+}
+
+// commandJson sends a command with the parameters encoded as the JSON body
+func (c *Client) commandJson(ctx context.Context, vin string, command string, params map[string]any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s parameters: %w", command, err)
+	}
+	return c.Command(ctx, vin, command, string(body))
+}
+
+// WakeUp wakes the vehicle and waits until it is awake
+func (c *Client) WakeUp(ctx context.Context, vin string) error {
+	_, err := c.Post(ctx, fmt.Sprintf("/api/1/vehicles/%s/wake_up?wait=true", url.PathEscape(vin)), "")
+	return err
+}
+
+func (c *Client) DoorLock(ctx context.Context, vin string) error {
+	return c.Command(ctx, vin, "door_lock", "")
+}
+
+func (c *Client) DoorUnlock(ctx context.Context, vin string) error {
+	return c.Command(ctx, vin, "door_unlock", "")
+}
+
+func (c *Client) HonkHorn(ctx context.Context, vin string) error {
+	return c.Command(ctx, vin, "honk_horn", "")
+}
+
+func (c *Client) FlashLights(ctx context.Context, vin string) error {
+	return c.Command(ctx, vin, "flash_lights", "")
+}
+
+func (c *Client) ChargeStart(ctx context.Context, vin string) error {
+	return c.Command(ctx, vin, "charge_start", "")
+}
+
+func (c *Client) ChargeStop(ctx context.Context, vin string) error {
+	return c.Command(ctx, vin, "charge_stop", "")
+}
+
+func (c *Client) ChargePortDoorOpen(ctx context.Context, vin string) error {
+	return c.Command(ctx, vin, "charge_port_door_open", "")
+}
+
+func (c *Client) ChargePortDoorClose(ctx context.Context, vin string) error {
+	return c.Command(ctx, vin, "charge_port_door_close", "")
+}
+
+// SetChargingAmps sets the charging current in amps
+func (c *Client) SetChargingAmps(ctx context.Context, vin string, amps int) error {
+	return c.commandJson(ctx, vin, "set_charging_amps", map[string]any{"charging_amps": amps})
+}
+
+// SetChargeLimit sets the charge limit in percent
+func (c *Client) SetChargeLimit(ctx context.Context, vin string, percent int) error {
+	return c.commandJson(ctx, vin, "set_charge_limit", map[string]any{"percent": percent})
+}
+
+func (c *Client) AutoConditioningStart(ctx context.Context, vin string) error {
+	return c.Command(ctx, vin, "auto_conditioning_start", "")
+}
+
+func (c *Client) AutoConditioningStop(ctx context.Context, vin string) error {
+	return c.Command(ctx, vin, "auto_conditioning_stop", "")
+}
+
+// SetTemps sets the driver and passenger temperature in degrees Celsius
+func (c *Client) SetTemps(ctx context.Context, vin string, driver float64, passenger float64) error {
+	return c.commandJson(ctx, vin, "set_temps", map[string]any{"driver_temp": driver, "passenger_temp": passenger})
+}
+
+func (c *Client) SetSentryMode(ctx context.Context, vin string, on bool) error {
+	return c.commandJson(ctx, vin, "set_sentry_mode", map[string]any{"on": on})
+}
+
+// ActuateTrunk opens or closes the trunk, which is `front` or `rear`
+func (c *Client) ActuateTrunk(ctx context.Context, vin string, which string) error {
+	return c.commandJson(ctx, vin, "actuate_trunk", map[string]any{"which_trunk": which})
+}
+
+// WindowControl vents or closes the windows, command is `vent` or `close`
+func (c *Client) WindowControl(ctx context.Context, vin string, command string) error {
+	return c.commandJson(ctx, vin, "window_control", map[string]any{"command": command})
+}
@@ -0,0 +1,67 @@
+package proxyclient
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// ErrNotInRange is matched by errors.Is when the proxy could not reach the vehicle over BLE
+var ErrNotInRange = errors.New("vehicle not in range")
+
+// ErrCircuitOpen is returned instead of sending requests while the proxy keeps failing
+var ErrCircuitOpen = errors.New("proxy circuit breaker is open")
+
+// ErrUnauthorized is returned when a reverse proxy in front of the proxy rejects the credentials
+var ErrUnauthorized = errors.New("proxy rejected the credentials")
+
+// Error is returned when the proxy reports that the request has failed
+type Error struct {
+	// Reason given by the proxy, e.g. `vehicle not in range`
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("command failed: %s", e.Reason)
+}
+
+func (e *Error) Is(target error) bool {
+	return target == ErrNotInRange && strings.Contains(e.Reason, "vehicle not in range")
+}
+
+// Prefixes of proxy reasons that are worth retrying, a BLE connection to the vehicle that failed
+// or timed out often works on the next attempt
+var retryableReasons = []string{"context deadline exceeded", "timeout", "timed out", "vehicle is busy", "try again", "failed to connect to vehicle", "connection lost", "disconnected"}
+
+// Prefixes of proxy reasons that mean the proxy itself is broken, not just one of its vehicles
+var adapterReasons = []string{"adapter", "bluetooth adapter", "ble adapter", "no bluetooth adapter", "failed to open adapter", "failed to initialize adapter"}
+
+// hasReason reports if err is an Error with a reason starting with one of the prefixes
+func hasReason(err error, prefixes []string) bool {
+	var proxy_err *Error
+	if !errors.As(err, &proxy_err) {
+		return false
+	}
+	reason := strings.ToLower(strings.TrimSpace(proxy_err.Reason))
+	return slices.ContainsFunc(prefixes, func(prefix string) bool {
+		return strings.HasPrefix(reason, prefix)
+	})
+}
+
+// IsRetryable reports if a failed request might succeed when sent again
+func IsRetryable(err error) bool {
+	return hasReason(err, retryableReasons) || isProxyFailure(err)
+}
+
+// isProxyFailure reports if the proxy could not be reached or its adapter failed. Only these count
+// toward the circuit breaker, which is shared by every vehicle of the proxy, so a single vehicle at
+// the edge of range does not take the others offline.
+func isProxyFailure(err error) bool {
+	if hasReason(err, adapterReasons) {
+		return true
+	}
+	var url_err *url.Error
+	return errors.As(err, &url_err)
+}
@@ -0,0 +1,41 @@
+package proxyclient
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+)
+
+func TestErrorClassification(t *testing.T) {
+	tests := []struct {
+		err           error
+		retryable     bool
+		proxy_failure bool
+		not_in_range  bool
+	}{
+		{&Error{Reason: "vehicle not in range"}, false, false, true},
+		{&Error{Reason: "unable to wake vehicle"}, false, false, false},
+		{&Error{Reason: "not enabled"}, false, false, false},
+		{&Error{Reason: "car is not connectable"}, false, false, false},
+		{&Error{Reason: "context deadline exceeded"}, true, false, false},
+		{&Error{Reason: "vehicle is busy"}, true, false, false},
+		{&Error{Reason: "Failed to connect to vehicle: timeout"}, true, false, false},
+		{&Error{Reason: "adapter not available"}, true, true, false},
+		{&Error{Reason: "failed to open adapter hci0"}, true, true, false},
+		{fmt.Errorf("failed to send request: %w", &url.Error{Op: "Get", URL: "http://proxy", Err: errors.New("connection refused")}), true, true, false},
+		{fmt.Errorf("failed to decode response: %w", errors.New("EOF")), false, false, false},
+		{ErrCircuitOpen, false, false, false},
+	}
+	for _, test := range tests {
+		if got := IsRetryable(test.err); got != test.retryable {
+			t.Errorf("IsRetryable(%v) = %v, want %v", test.err, got, test.retryable)
+		}
+		if got := isProxyFailure(test.err); got != test.proxy_failure {
+			t.Errorf("isProxyFailure(%v) = %v, want %v", test.err, got, test.proxy_failure)
+		}
+		if got := errors.Is(test.err, ErrNotInRange); got != test.not_in_range {
+			t.Errorf("errors.Is(%v, ErrNotInRange) = %v, want %v", test.err, got, test.not_in_range)
+		}
+	}
+}
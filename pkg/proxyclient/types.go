@@ -0,0 +1,138 @@
+package proxyclient
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Vehicle sleep status reported by the body controller
+const (
+	SleepStatusAwake  = "VEHICLE_SLEEP_STATUS_AWAKE"
+	SleepStatusAsleep = "VEHICLE_SLEEP_STATUS_ASLEEP"
+)
+
+// Response is implemented by every typed response, Raw returns the response as sent by the proxy,
+// including the fields that are not part of the struct
+type Response interface {
+	Raw() map[string]any
+}
+
+type raw struct {
+	raw map[string]any
+}
+
+func (r *raw) Raw() map[string]any {
+	return r.raw
+}
+
+// decode fills a typed response from the raw one. Fields with an unexpected type are left empty
+// instead of failing the request, the proxy and vehicle firmware add and change fields over time.
+func decode[T any](response map[string]any, value *T) error {
+	data, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	var type_err *json.UnmarshalTypeError
+	if err := json.Unmarshal(data, value); err != nil && !errors.As(err, &type_err) {
+		return err
+	}
+	return nil
+}
+
+// ConnectionStatus is the BLE connection status of a vehicle, from /api/proxy/1/vehicles/{vin}/connection_status
+type ConnectionStatus struct {
+	raw
+	// BLE address of the vehicle, empty if it is not in range
+	Address     string `json:"address"`
+	Connectable bool   `json:"connectable"`
+	LocalName   string `json:"local_name"`
+	Operated    bool   `json:"operated"`
+	Rssi        int    `json:"rssi"`
+}
+
+// InRange reports if the proxy can see the vehicle
+func (c *ConnectionStatus) InRange() bool {
+	return c.Address != ""
+}
+
+// BodyControllerState is read without waking the vehicle, from /api/proxy/1/vehicles/{vin}/body_controller_state
+type BodyControllerState struct {
+	raw
+	VehicleLockState   string            `json:"vehicle_lock_state"`
+	VehicleSleepStatus string            `json:"vehicle_sleep_status"`
+	UserPresence       string            `json:"user_presence"`
+	ClosureStatuses    map[string]string `json:"closure_statuses"`
+}
+
+// Awake reports if vehicle_data can be requested without waking the vehicle
+func (b *BodyControllerState) Awake() bool {
+	return b.VehicleSleepStatus == SleepStatusAwake
+}
+
+type ChargeState struct {
+	BatteryLevel            int     `json:"battery_level"`
+	UsableBatteryLevel      int     `json:"usable_battery_level"`
+	BatteryRange            float64 `json:"battery_range"`
+	ChargingState           string  `json:"charging_state"`
+	ChargeLimitSoc          int     `json:"charge_limit_soc"`
+	ChargeCurrentRequest    int     `json:"charge_current_request"`
+	ChargeCurrentRequestMax int     `json:"charge_current_request_max"`
+	ChargerActualCurrent    int     `json:"charger_actual_current"`
+	ChargerVoltage          int     `json:"charger_voltage"`
+	ChargerPower            float64 `json:"charger_power"`
+	ChargeEnergyAdded       float64 `json:"charge_energy_added"`
+	MinutesToFullCharge     int     `json:"minutes_to_full_charge"`
+	ChargePortDoorOpen      bool    `json:"charge_port_door_open"`
+	ConnChargeCable         string  `json:"conn_charge_cable"`
+	Timestamp               int64   `json:"timestamp"`
+}
+
+type ClimateState struct {
+	InsideTemp           *float64 `json:"inside_temp"`
+	OutsideTemp          *float64 `json:"outside_temp"`
+	DriverTempSetting    float64  `json:"driver_temp_setting"`
+	PassengerTempSetting float64  `json:"passenger_temp_setting"`
+	IsClimateOn          bool     `json:"is_climate_on"`
+	IsAutoConditioningOn bool     `json:"is_auto_conditioning_on"`
+	IsPreconditioning    bool     `json:"is_preconditioning"`
+	ClimateKeeperMode    string   `json:"climate_keeper_mode"`
+	Timestamp            int64    `json:"timestamp"`
+}
+
+type DriveState struct {
+	Latitude   *float64 `json:"latitude"`
+	Longitude  *float64 `json:"longitude"`
+	Heading    *float64 `json:"heading"`
+	Speed      *float64 `json:"speed"`
+	Power      *float64 `json:"power"`
+	ShiftState *string  `json:"shift_state"`
+	Timestamp  int64    `json:"timestamp"`
+}
+
+type VehicleState struct {
+	Odometer       float64  `json:"odometer"`
+	Locked         bool     `json:"locked"`
+	SentryMode     bool     `json:"sentry_mode"`
+	CarVersion     string   `json:"car_version"`
+	TpmsPressureFl *float64 `json:"tpms_pressure_fl"`
+	TpmsPressureFr *float64 `json:"tpms_pressure_fr"`
+	TpmsPressureRl *float64 `json:"tpms_pressure_rl"`
+	TpmsPressureRr *float64 `json:"tpms_pressure_rr"`
+	Timestamp      int64    `json:"timestamp"`
+}
+
+// VehicleData is the response of /api/1/vehicles/{vin}/vehicle_data, endpoints that were not
+// requested are nil
+type VehicleData struct {
+	raw
+	ChargeState  *ChargeState  `json:"charge_state"`
+	ClimateState *ClimateState `json:"climate_state"`
+	DriveState   *DriveState   `json:"drive_state"`
+	VehicleState *VehicleState `json:"vehicle_state"`
+}
+
+// Endpoint returns the raw response of a single vehicle_data endpoint, nil if it is missing
+func (v *VehicleData) Endpoint(endpoint string) map[string]any {
+	response, _ := v.raw.raw[endpoint].(map[string]any)
+	return response
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"TeslaBle2Mqtt/internal/discovery"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/akamensky/argparse"
+	"github.com/charmbracelet/log"
+)
+
+// renderedHandler is the output of the `render` subcommand for a single handler
+type renderedHandler struct {
+	Id                   string                       `json:"id"`
+	Vin                  string                       `json:"vin"`
+	DeviceType           discovery.DeviceType         `json:"device_type"`
+	DiscoveryTopic       string                       `json:"discovery_topic"`
+	Discovery            json.RawMessage              `json:"discovery"`
+	PublishBindings      map[string]string            `json:"publish_bindings"`
+	SubscribeBindings    map[string]map[string]string `json:"subscribe_bindings"`
+	VehicleDataEndpoints []string                     `json:"vehicle_data_endpoints,omitempty"`
+}
+
+func renderHandler(d *discovery.DiscoveryHandler) renderedHandler {
+	sub := make(map[string]map[string]string)
+	for topic, commands := range d.SubscribeBindings {
+		sub[topic] = make(map[string]string)
+		for command, action := range commands {
+			sub[topic][command] = action.Command
+			if action.Body != "" {
+				sub[topic][command] += "|" + action.Body
+			}
+		}
+	}
+	return renderedHandler{
+		Id:                   d.Id,
+		Vin:                  d.Vin,
+		DeviceType:           d.Discovery.DeviceType,
+		DiscoveryTopic:       d.Discovery.Topic,
+		Discovery:            d.Discovery.Message,
+		PublishBindings:      d.PublishBindings,
+		SubscribeBindings:    sub,
+		VehicleDataEndpoints: d.VehicleDataEndpoints,
+	}
+}
+
+// sortedKeys returns map keys in order, so the output can be diffed
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func renderTable(w io.Writer, handlers []renderedHandler) error {
+	for _, h := range handlers {
+		fmt.Fprintf(w, "== %s (%s, vin %s) ==\n", h.Id, h.DeviceType, h.Vin)
+		fmt.Fprintf(w, "Discovery topic: %s\n", h.DiscoveryTopic)
+		if len(h.VehicleDataEndpoints) > 0 {
+			fmt.Fprintf(w, "Vehicle data endpoints: %s\n", strings.Join(h.VehicleDataEndpoints, ", "))
+		}
+
+		var message bytes.Buffer
+		if err := json.Indent(&message, h.Discovery, "", "  "); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Discovery:\n%s\n\n", message.String())
+
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "STATE TOPIC\tACCESS PATH")
+		for _, topic := range sortedKeys(h.PublishBindings) {
+			fmt.Fprintf(tw, "%s\t%s\n", topic, h.PublishBindings[topic])
+		}
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "COMMAND TOPIC\tCOMMAND\tACTION")
+		for _, topic := range sortedKeys(h.SubscribeBindings) {
+			for _, command := range sortedKeys(h.SubscribeBindings[topic]) {
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", topic, command, h.SubscribeBindings[topic][command])
+			}
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+// runRender implements the `render` subcommand, it prints the discovery messages and bindings
+// generated from a sensors YAML file and returns the exit code
+func runRender(args []string) int {
+	parser := argparse.NewParser("render", "Print the discovery messages and bindings generated from a sensors YAML file")
+	sensors_yaml := parser.String("y", "sensors-yaml", &argparse.Options{Required: false, Help: "Path to custom sensors YAML file (renders the default one if not set)", Default: ""})
+	sensors_overlays := parser.StringList("Y", "sensors-overlay", &argparse.Options{Required: false, Help: "Path to sensors YAML file deep merged onto the sensors configuration (Can be specified multiple times)"})
+	effective := parser.Flag("e", "effective", &argparse.Options{Required: false, Help: "Print the sensors configuration after includes and overlays are applied instead"})
+	vins := parser.StringList("v", "vin", &argparse.Options{Required: false, Help: "VIN to render per vehicle devices for (Can be specified multiple times)", Default: []string{discovery.PlaceholderVin}})
+	format := parser.Selector("f", "format", []string{"json", "table"}, &argparse.Options{Required: false, Help: "Output format", Default: "table"})
+	discovery_prefix := parser.String("d", "discovery-prefix", &argparse.Options{Required: false, Help: "MQTT discovery prefix", Default: "homeassistant"})
+	mqtt_prefix := parser.String("m", "mqtt-prefix", &argparse.Options{Required: false, Help: "MQTT prefix", Default: "tb2m"})
+	max_charging_amps := parser.Int("A", "max-charging-amps", &argparse.Options{Required: false, Help: "Max charging amps", Default: 16})
+	if err := parser.Parse(args); err != nil {
+		fmt.Print(parser.Usage(err))
+		return 2
+	}
+	log.SetOutput(os.Stderr)
+
+	if *effective {
+		out, err := discovery.EffectiveSensorsYaml(*sensors_yaml, *sensors_overlays)
+		if err != nil {
+			fmt.Printf("Failed to load sensors configuration: %s\n", err)
+			return 1
+		}
+		fmt.Print(string(out))
+		return 0
+	}
+
+	vinReplacements := make(map[string]map[string]string)
+	for _, vin := range *vins {
+		if len(vin) != 17 {
+			fmt.Printf("invalid VIN (%s)\n", vin)
+			return 2
+		}
+		vinReplacements[vin] = map[string]string{
+			"max_charging_amps": strconv.Itoa(*max_charging_amps),
+		}
+	}
+
+	discoveries, err := discovery.GetDiscovery(*sensors_yaml, discovery.DiscoverySettings{
+		DiscoveryPrefix:  *discovery_prefix,
+		MqttPrefix:       *mqtt_prefix,
+		Vins:             *vins,
+		Version:          "dev",
+		ConfigurationUrl: "http://localhost:8080/dashboard",
+		VinReplacements:  vinReplacements,
+		SensorsOverlays:  *sensors_overlays,
+	})
+	if err != nil {
+		fmt.Printf("Failed to get discovery: %s\n", err)
+		return 1
+	}
+
+	handlers := make([]renderedHandler, len(discoveries))
+	for i := range discoveries {
+		handlers[i] = renderHandler(&discoveries[i])
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetEscapeHTML(false) // Keep value templates readable
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(handlers); err != nil {
+			fmt.Printf("Failed to marshal: %s\n", err)
+			return 1
+		}
+		return 0
+	}
+	if err := renderTable(os.Stdout, handlers); err != nil {
+		fmt.Printf("Failed to render: %s\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"TeslaBle2Mqtt/internal/discovery"
+	"fmt"
+
+	"github.com/akamensky/argparse"
+)
+
+// runValidate implements the `validate` subcommand, it checks a sensors YAML file and
+// returns the exit code
+func runValidate(args []string) int {
+	parser := argparse.NewParser("validate", "Check a sensors YAML file for errors without connecting to the proxy or MQTT")
+	sensors_yaml := parser.String("y", "sensors-yaml", &argparse.Options{Required: false, Help: "Path to custom sensors YAML file (checks the default one if not set)", Default: ""})
+	sensors_overlays := parser.StringList("Y", "sensors-overlay", &argparse.Options{Required: false, Help: "Path to sensors YAML file deep merged onto the sensors configuration (Can be specified multiple times)"})
+	if err := parser.Parse(args); err != nil {
+		fmt.Print(parser.Usage(err))
+		return 2
+	}
+
+	base := *sensors_yaml
+	if base == "" {
+		base = "default sensors configuration"
+	}
+	name := base
+	if len(*sensors_overlays) > 0 {
+		name += " with overlays"
+	}
+
+	errors, err := discovery.Validate(*sensors_yaml, *sensors_overlays)
+	if err != nil {
+		fmt.Printf("%s: %s\n", name, err)
+		return 1
+	}
+	for _, e := range errors {
+		if e.Line == 0 {
+			fmt.Printf("%s: %s\n", name, e.Message)
+		} else {
+			// Values from the default configuration have no file
+			file := e.File
+			if file == "" {
+				file = base
+			}
+			fmt.Printf("%s:%d: %s\n", file, e.Line, e.Message)
+		}
+	}
+	if len(errors) > 0 {
+		fmt.Printf("%d problem(s) found\n", len(errors))
+		return 1
+	}
+	fmt.Printf("%s is valid\n", name)
+	return 0
+}